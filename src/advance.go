@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"math/rand"
 	"sync"
-	"time"
 )
 
 func forceQuitTest() (bool, int, int) {
@@ -33,7 +32,7 @@ func forceQuitTest() (bool, int, int) {
 		wg.Add(1)
 		go nodes[i].Run()
 	}
-	time.Sleep(forceQuitAfterRunSleepTime)
+	clock.Sleep(forceQuitAfterRunSleepTime)
 
 	/* Node 0 creates a new network. All notes join the network. */
 	joinInfo := testInfo{
@@ -53,11 +52,11 @@ func forceQuitTest() (bool, int, int) {
 		}
 		nodesInNetwork = append(nodesInNetwork, i)
 
-		time.Sleep(forceQuitJoinSleepTime)
+		clock.Sleep(forceQuitJoinSleepTime)
 	}
 	joinInfo.finish(&forceQuitFailedCnt, &forceQuitTotalCnt)
 
-	time.Sleep(forceQuitAfterJoinSleepTime)
+	clock.Sleep(forceQuitAfterJoinSleepTime)
 
 	/* Put. */
 	putInfo := testInfo{
@@ -91,7 +90,7 @@ func forceQuitTest() (bool, int, int) {
 			nodes[nodesInNetwork[idxInArray]].ForceQuit()
 			nodesInNetwork = removeFromArray(nodesInNetwork, idxInArray)
 
-			time.Sleep(forceQuitFQSleepTime)
+			clock.Sleep(forceQuitFQSleepTime)
 		}
 
 		/* Get all data. */
@@ -146,7 +145,7 @@ func quitAndStabilizeTest() (bool, int, int) {
 		wg.Add(1)
 		go nodes[i].Run()
 	}
-	time.Sleep(QASAfterRunSleepTime)
+	clock.Sleep(QASAfterRunSleepTime)
 
 	/* Node 0 creates a new network. All notes join the network. */
 	joinInfo := testInfo{
@@ -166,11 +165,11 @@ func quitAndStabilizeTest() (bool, int, int) {
 		}
 		nodesInNetwork = append(nodesInNetwork, i)
 
-		time.Sleep(QASJoinSleepTime)
+		clock.Sleep(QASJoinSleepTime)
 	}
 	joinInfo.finish(&QASFailedCnt, &QASTotalCnt)
 
-	time.Sleep(QASAfterJoinSleepTime)
+	clock.Sleep(QASAfterJoinSleepTime)
 
 	/* Put. */
 	putInfo := testInfo{
@@ -205,7 +204,7 @@ func quitAndStabilizeTest() (bool, int, int) {
 		nodes[nodesInNetwork[idxInArray]].Quit()
 		nodesInNetwork = removeFromArray(nodesInNetwork, idxInArray)
 
-		time.Sleep(QASQuitSleepTime)
+		clock.Sleep(QASQuitSleepTime)
 
 		/* Get some data. */
 		getCnt := 0
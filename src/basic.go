@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"math/rand"
 	"sync"
-	"time"
 )
 
 func basicTest() (bool, int, int) {
@@ -33,7 +32,7 @@ func basicTest() (bool, int, int) {
 
 	nodesInNetwork := make([]int, 0, basicTestNodeSize+1)
 
-	time.Sleep(basicTestAfterRunSleepTime)
+	clock.Sleep(basicTestAfterRunSleepTime)
 
 	/* Node 0 now creates a new network. */
 	nodes[0].Create()
@@ -60,12 +59,12 @@ func basicTest() (bool, int, int) {
 			}
 			nodesInNetwork = append(nodesInNetwork, nextJoinNode)
 
-			time.Sleep(basicTestJoinQuitSleepTime)
+			clock.Sleep(basicTestJoinQuitSleepTime)
 			nextJoinNode++
 		}
 		joinInfo.finish(&basicFailedCnt, &basicTotalCnt)
 
-		time.Sleep(basicTestAfterJoinQuitSleepTime)
+		clock.Sleep(basicTestAfterJoinQuitSleepTime)
 
 		/* Put, part 1. */
 		put1Info := testInfo{
@@ -140,10 +139,10 @@ func basicTest() (bool, int, int) {
 			nodes[nodesInNetwork[idxInArray]].Quit()
 			nodesInNetwork = removeFromArray(nodesInNetwork, idxInArray)
 
-			time.Sleep(basicTestJoinQuitSleepTime)
+			clock.Sleep(basicTestJoinQuitSleepTime)
 		}
 		_, _ = green.Printf("Quit (round %d) passed.\n", t)
-		time.Sleep(basicTestAfterJoinQuitSleepTime)
+		clock.Sleep(basicTestAfterJoinQuitSleepTime)
 
 		/* Put, part 2. */
 		put2Info := testInfo{
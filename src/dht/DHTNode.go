@@ -1,104 +1,422 @@
 package dht
 
 import (
+	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
+// DHTNode is a node of the ring. It takes one position on the ring per
+// virtual node, the first of which coordinates its requests.
 type DHTNode struct {
 	node *ChordNode
-	server *Server
+	nodes []*ChordNode
+	servers []*Server
+	virtualNodes int
+	weight float64
 }
 
 func (this *DHTNode) SetPort(port int) {
-	this.node = NewChordNode(port)
+	this.SetPortWithTransport(port, DefaultTransport)
+}
+
+func (this *DHTNode) SetPortWithTransport(port int, transport Transport) {
+	this.node = NewChordNode(port, transport)
+	this.nodes = []*ChordNode{this.node}
+	this.virtualNodes, this.weight = 1, 1
 	this.Create()
 }
 
-func (this *DHTNode) Run() {
-	this.server = NewServer(this.node)
-	if err := this.server.Launch() ; err != nil {
-		log.Errorf("Cannot run node at %s.\n", this.node.address)
+// SetVirtualNodes gives the node n positions on the ring, each owning the keys
+// up to it, so that few nodes still share the keys evenly. Call it before Run,
+// SetStores and SetStorage.
+//
+// The replicas of a key are kept on other nodes than its owner, skipping the
+// successors which are virtual nodes of the owner or of another replica.
+func (this *DHTNode) SetVirtualNodes(n int) {
+	this.virtualNodes = n
+	this.resize()
+}
+
+// SetWeight scales the number of virtual nodes, so that a node of weight 2
+// owns about twice the keys of a node of weight 1.
+func (this *DHTNode) SetWeight(weight float64) {
+	this.weight = weight
+	this.resize()
+}
+
+func (this *DHTNode) resize() {
+	if this.node.listening {
+		log.Errorf("Cannot change the virtual nodes of %s while it runs.\n", this.node.address)
 		return
 	}
-	this.node.Maintain()
-	time.Sleep(maintainPeriod)
+	n := int(math.Round(float64(this.virtualNodes) * this.weight))
+	if n < 1 {
+		n = 1
+	}
+	for len(this.nodes) < n {
+		this.nodes = append(this.nodes, this.node.virtualNode(len(this.nodes)))
+	}
+	this.nodes = this.nodes[: n]
+}
+
+// SetStores plugs in the stores of the primary data and of the replicas. Call
+// it before Run. With virtual nodes, each needs stores of its own, see
+// SetVirtualStores.
+func (this *DHTNode) SetStores(data Store, backup Store) {
+	this.node.SetStores(data, backup)
+}
+
+// SetVirtualStores plugs in the stores of each virtual node, numbered from 0.
+// Call it before Run.
+func (this *DHTNode) SetVirtualStores(stores func(i int) (data Store, backup Store)) {
+	for i, node := range this.nodes {
+		node.SetStores(stores(i))
+	}
+}
+
+// SetStorage keeps the data of the node in dir, and recovers the data found
+// there. Virtual nodes beyond the first keep theirs in numbered subdirectories.
+// Call it before Run.
+func (this *DHTNode) SetStorage(dir string) error {
+	for i, node := range this.nodes {
+		path := dir
+		if i > 0 {
+			path = filepath.Join(dir, strconv.Itoa(i))
+		}
+		if err := node.OpenStorage(path) ; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *DHTNode) SetClock(clock Clock) {
+	for _, node := range this.nodes {
+		node.SetClock(clock)
+	}
+}
+
+func (this *DHTNode) SetMaintainPeriod(period time.Duration) {
+	for _, node := range this.nodes {
+		node.SetMaintainPeriod(period)
+	}
+}
+
+func (this *DHTNode) SetReplicas(n int) error {
+	for _, node := range this.nodes {
+		if err := node.SetReplicas(n) ; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetConsistency sets the levels of Put, Get and Delete, which are ONE for
+// reads and ALL for writes unless set.
+func (this *DHTNode) SetConsistency(read, write Consistency) {
+	for _, node := range this.nodes {
+		node.SetConsistency(read, write)
+	}
+}
+
+// SetLookupMode sets how the lookups of the node proceed, recursively unless
+// set.
+func (this *DHTNode) SetLookupMode(mode LookupMode) {
+	for _, node := range this.nodes {
+		node.SetLookupMode(mode)
+	}
+}
+
+// SetSuspicionThreshold sets the phi above which a peer is taken for failed, 8
+// unless set. Lower it to detect failures sooner, raise it to make fewer
+// mistakes on a slow network.
+func (this *DHTNode) SetSuspicionThreshold(phi float64) {
+	for _, node := range this.nodes {
+		node.SetSuspicionThreshold(phi)
+	}
+}
+
+// Suspicion returns the phi of addr as seen by the node, 0 if the node does not
+// follow it and +Inf if it is known to be down.
+func (this *DHTNode) Suspicion(addr string) float64 {
+	return this.node.Suspicion(addr)
+}
+
+// Suspicions returns the phi of every peer the node follows.
+func (this *DHTNode) Suspicions() map[string] float64 {
+	return this.node.detector.Levels()
+}
+
+func (this *DHTNode) SetTombstoneGrace(grace time.Duration) {
+	for _, node := range this.nodes {
+		node.SetTombstoneGrace(grace)
+	}
+}
+
+func (this *DHTNode) Run() {
+	this.servers = make([]*Server, len(this.nodes))
+	for i, node := range this.nodes {
+		this.servers[i] = NewServer(node, node.transport)
+		if err := this.servers[i].Launch() ; err != nil {
+			log.Errorf("Cannot run node at %s.\n", node.address)
+			for _, server := range this.servers[: i] {
+				server.Shutdown()
+			}
+			return
+		}
+	}
+	for _, node := range this.nodes {
+		node.Maintain()
+	}
+	this.node.clock.Sleep(this.node.period)
 	log.Tracef("Successfully run %s.\n", this.node.address)
 }
 
+// Create starts a ring, which the other virtual nodes then join.
 func (this *DHTNode) Create() {
 	this.node.Create()
+	if !this.node.listening {
+		return
+	}
+	for _, node := range this.nodes[1 :] {
+		if !this.join(node, this.node.address) {
+			log.Errorf("Virtual node %s failed to join.\n", node.address)
+		}
+	}
 }
 
 func (this *DHTNode) Join(addr string) bool {
-	time.Sleep(halfMaintainPeriod)
-	if err := this.node.Join(addr) ; err != nil {
+	for _, node := range this.nodes {
+		if !this.join(node, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *DHTNode) join(node *ChordNode, addr string) bool {
+	node.clock.Sleep(node.period / 2)
+	if err := node.Join(addr) ; err != nil {
 		log.Errorln("First join attempt error.", err)
-		time.Sleep(maintainPeriod)
-		err = this.node.Join(addr)
+		node.clock.Sleep(node.period)
+		err = node.Join(addr)
 		if err != nil {
 			return false
 		}
 	}
-	time.Sleep(maintainPeriod)
+	node.clock.Sleep(node.period)
 	return true
 }
 
+// Quit hands the keys of each virtual node over to its successor. The first
+// one goes last, as the others share its listener.
 func (this *DHTNode) Quit() {
-	this.ForceQuit()
+	if this.node.listening == false {
+		return
+	}
+	for i := len(this.nodes) - 1 ; i >= 0 ; i -- {
+		node := this.nodes[i]
+		// The data is only dropped once handed over. Stores on disk are
+		// closed first, so that they keep it either way.
+		handed := node.Quit()
+		if handed != nil {
+			log.Errorf("Node %s failed to quit gracefully: %s.\n", node.address, handed)
+		}
+		this.servers[i].Shutdown()
+		if err := node.CloseStorage() ; err != nil {
+			log.Errorln("Quit: ", err)
+		}
+		if handed == nil {
+			node.Clear()
+		}
+		log.Tracef("Quit at node %s.\n", node.address)
+		node.clock.Sleep(node.period)
+	}
 }
 
 func (this *DHTNode) ForceQuit() {
-	this.server.Shutdown()
-	this.node.Clear()
+	if this.node.listening == false {
+		return
+	}
+	for i := len(this.nodes) - 1 ; i >= 0 ; i -- {
+		node := this.nodes[i]
+		this.servers[i].Shutdown()
+		if err := node.CloseStorage() ; err != nil {
+			log.Errorln("ForceQuit: ", err)
+		}
+		node.Clear()
+	}
 	log.Tracef("Force quit at node %s.\n", this.node.address)
-	time.Sleep(maintainPeriod * 3)
+	this.node.clock.Sleep(this.node.period * 3)
 }
 
 func (this *DHTNode) Ping(addr string) bool {
-	return CheckValidRPC(addr)
+	return this.node.transport.Ping(addr)
 }
 
 func (this *DHTNode) Put(key string, value string) bool {
+	return this.PutContext(context.Background(), key, value) == nil
+}
+
+func (this *DHTNode) PutContext(ctx context.Context, key string, value string) error {
+	return this.PutConsistent(ctx, key, value, this.node.writeLevel)
+}
+
+// PutConsistent returns once w replicas of the key hold the value.
+func (this *DHTNode) PutConsistent(ctx context.Context, key string, value string, w Consistency) error {
 	if this.node.listening == false {
 		log.Errorf("%s not listening.\n", this.node.address)
-		return false
+		return &OpError{"put", key, NotJoinedError}
 	}
-	var result bool
-	if !this.node.PutOnChord(key, value) {
-		time.Sleep(maintainPeriod)
-		result = this.node.PutOnChord(key, value)
-	} else {
-		result = true
+	err := this.node.PutOnReplicas(ctx, key, value, w)
+	if err != nil {
+		if this.wait(ctx, this.node.period) != nil {
+			return &OpError{"put", key, err}
+		}
+		err = this.node.PutOnReplicas(ctx, key, value, w)
 	}
 	//time.Sleep(maintainPeriod)
-	return result
+	if err != nil {
+		return &OpError{"put", key, err}
+	}
+	return nil
 }
 
 func (this *DHTNode) Get(key string) (bool, string) {
+	value, err := this.GetContext(context.Background(), key)
+	return err == nil, value
+}
+
+// GetContext returns NotFoundError for an absent key, while an empty value is
+// returned as such. It returns ConflictError if the key has concurrent
+// versions.
+func (this *DHTNode) GetContext(ctx context.Context, key string) (string, error) {
+	return this.GetConsistent(ctx, key, this.node.readLevel)
+}
+
+// GetConsistent reads the key from r of its replicas.
+func (this *DHTNode) GetConsistent(ctx context.Context, key string, r Consistency) (string, error) {
 	if this.node.listening == false {
 		log.Errorf("%s not listening.\n", this.node.address)
-		return false, ""
+		return "", &OpError{"get", key, NotJoinedError}
 	}
+	var err error
 	for trial := 0 ; trial < 3 ; trial ++ {
-		ok, value := this.node.GetOnChord(key)
-		if ok {
-			return true, value
+		var value string
+		value, err = this.node.GetOnReplicas(ctx, key, r)
+		if err == nil {
+			return value, nil
+		}
+		if this.wait(ctx, this.node.period) != nil {
+			break
 		}
-		time.Sleep(maintainPeriod)
 	}
 	log.Warningf("Value of %s not found.\n", key)
-	return false, ""
+	return "", &OpError{"get", key, err}
+}
+
+// GetVersions returns the concurrent versions of the key held by r of its
+// replicas, for the caller to resolve with Resolve.
+func (this *DHTNode) GetVersions(ctx context.Context, key string, r Consistency) (Siblings, error) {
+	if this.node.listening == false {
+		return nil, &OpError{"get", key, NotJoinedError}
+	}
+	versions, err := this.node.GetVersionsOnReplicas(ctx, key, r)
+	if err != nil {
+		return nil, &OpError{"get", key, err}
+	}
+	return versions, nil
+}
+
+// Resolve writes value as the successor of the versions merged in seen,
+// usually the Context of the siblings returned by GetVersions.
+func (this *DHTNode) Resolve(ctx context.Context, key string, value string, seen VectorClock, w Consistency) error {
+	if this.node.listening == false {
+		return &OpError{"resolve", key, NotJoinedError}
+	}
+	if err := this.node.PutVersionOnReplicas(ctx, key, value, seen, w) ; err != nil {
+		return &OpError{"resolve", key, err}
+	}
+	return nil
 }
 
 func (this *DHTNode) Delete(key string) bool {
+	return this.DeleteContext(context.Background(), key) == nil
+}
+
+func (this *DHTNode) DeleteContext(ctx context.Context, key string) error {
+	return this.DeleteConsistent(ctx, key, this.node.writeLevel)
+}
+
+// DeleteConsistent returns once w replicas of the key have dropped it.
+func (this *DHTNode) DeleteConsistent(ctx context.Context, key string, w Consistency) error {
 	if this.node.listening == false {
 		log.Errorf("%s not listening.\n", this.node.address)
-		return false
+		return &OpError{"delete", key, NotJoinedError}
 	}
-	ok, _ := this.node.DeleteOnChord(key)
+	_, err := this.node.DeleteOnReplicas(ctx, key, w)
 	//time.Sleep(maintainPeriod)
-	return ok
+	if err != nil {
+		return &OpError{"delete", key, err}
+	}
+	return nil
+}
+
+// TraceLookup finds the owner of the key the way the lookup mode of the node
+// says and tells how the lookup got there, hop by hop. A failed lookup is
+// retried as Get does, and the trace keeps the hops of every trial.
+func (this *DHTNode) TraceLookup(ctx context.Context, key string) (LookupTrace, error) {
+	if this.node.listening == false {
+		return LookupTrace{}, &OpError{"trace", key, NotJoinedError}
+	}
+	var trace LookupTrace
+	var hops []TraceHop
+	var err error
+	for trial := 0 ; trial < 3 ; trial ++ {
+		trace, err = this.node.TraceLookup(ctx, hashString(key))
+		hops = append(hops, trace.Hops...)
+		trace.Hops, trace.Retries = hops, trial
+		if err == nil {
+			return trace, nil
+		}
+		if this.wait(ctx, this.node.period) != nil {
+			break
+		}
+	}
+	return trace, &OpError{"trace", key, lookupError(err)}
+}
+
+// CheckRing walks the ring from the node and tells whether it is strongly
+// stable. A loopy ring is repaired on the way.
+func (this *DHTNode) CheckRing(ctx context.Context) (RingHealth, error) {
+	if this.node.listening == false {
+		return RingHealth{}, NotJoinedError
+	}
+	return this.node.CheckRing(ctx)
+}
+
+// RingHealth returns what the last walk round the ring from the node found.
+// Only the first node past zero walks the ring in the background; the others
+// report their own walks, see CheckRing, and the loops they repaired.
+func (this *DHTNode) RingHealth() RingHealth {
+	return this.node.RingHealth()
+}
+
+// wait sleeps before a retry, unless ctx is done first.
+func (this *DHTNode) wait(ctx context.Context, d time.Duration) error {
+	if ctx.Done() == nil {
+		this.node.clock.Sleep(d)
+		return nil
+	}
+	if this.node.clock.Wait(ctx.Done(), d) {
+		return ctx.Err()
+	}
+	return nil
 }
 
 func (this *DHTNode) Dump() {
@@ -106,5 +424,17 @@ func (this *DHTNode) Dump() {
 		log.Errorf("%s not listening.\n", this.node.address)
 		return
 	}
-	this.node.Dump()
+	for _, node := range this.nodes {
+		node.Dump()
+	}
+}
+
+// DumpLookup prints the route of a lookup of the key.
+func (this *DHTNode) DumpLookup(key string) {
+	trace, err := this.TraceLookup(context.Background(), key)
+	fmt.Printf("Tracing %s from %s.\n", key, this.node.address)
+	fmt.Print(trace)
+	if err != nil {
+		fmt.Printf("Lookup failed: %s.\n", err)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,19 @@
+package dht
+
+// KademliaDHTNode is a node of a Kademlia network, offering the same API as
+// DHTNode does over Chord.
+type KademliaDHTNode struct {
+	StampedDHTNode
+}
+
+func (this *KademliaDHTNode) SetPort(port int) {
+	this.SetPortWithTransport(port, DefaultTransport)
+}
+
+func (this *KademliaDHTNode) SetPortWithTransport(port int, transport Transport) {
+	this.node = NewKademliaNode(port, transport)
+}
+
+func (this *KademliaNode) service() interface{} {
+	return &KademliaWrapper{this}
+}
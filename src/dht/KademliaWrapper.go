@@ -0,0 +1,17 @@
+package dht
+
+type KademliaWrapper struct {
+	node *KademliaNode
+}
+
+func (this *KademliaWrapper) FindNode(args FindArgs, contacts *[]string) error {
+	return this.node.FindNode(args, contacts)
+}
+
+func (this *KademliaWrapper) FindValue(args FindArgs, reply *FindValueReply) error {
+	return this.node.FindValue(args, reply)
+}
+
+func (this *KademliaWrapper) Store(args StoreArgs, live *int) error {
+	return this.node.Store(args, live)
+}
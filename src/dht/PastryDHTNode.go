@@ -0,0 +1,19 @@
+package dht
+
+// PastryDHTNode is a node of a Pastry network, offering the same API as
+// DHTNode does over Chord.
+type PastryDHTNode struct {
+	StampedDHTNode
+}
+
+func (this *PastryDHTNode) SetPort(port int) {
+	this.SetPortWithTransport(port, DefaultTransport)
+}
+
+func (this *PastryDHTNode) SetPortWithTransport(port int, transport Transport) {
+	this.node = NewPastryNode(port, transport)
+}
+
+func (this *PastryNode) service() interface{} {
+	return &PastryWrapper{this}
+}
@@ -0,0 +1,29 @@
+package dht
+
+type PastryWrapper struct {
+	node *PastryNode
+}
+
+func (this *PastryWrapper) Route(args RouteArgs, root *string) error {
+	return this.node.Route(args, root)
+}
+
+func (this *PastryWrapper) State(args StateArgs, state *PastryState) error {
+	return this.node.State(args, state)
+}
+
+func (this *PastryWrapper) Announce(addr string, _ *int) error {
+	return this.node.Announce(addr, nil)
+}
+
+func (this *PastryWrapper) Depart(addr string, _ *int) error {
+	return this.node.Depart(addr, nil)
+}
+
+func (this *PastryWrapper) Store(args PastryStoreArgs, live *int) error {
+	return this.node.Store(args, live)
+}
+
+func (this *PastryWrapper) Fetch(args FetchArgs, reply *FetchReply) error {
+	return this.node.Fetch(args, reply)
+}
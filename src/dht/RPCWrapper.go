@@ -6,54 +6,99 @@ type RPCWrapper struct {
 	node *ChordNode
 }
 
-func (this *RPCWrapper) FindSuccessor(hashValue *big.Int, succaddr *string) error {
-	return this.node.FindSuccessor(hashValue, succaddr)
+func (this *RPCWrapper) Ping(_ int, alive *bool) error {
+	*alive = this.node.listening
+	return nil
+}
+
+func (this *RPCWrapper) FindSuccessor(args LookupArgs, succaddr *string) error {
+	ctx, cancel := args.Context()
+	defer cancel()
+	return this.node.findSuccessor(ctx, args, succaddr)
+}
+
+func (this *RPCWrapper) TraceSuccessor(args LookupArgs, trace *LookupTrace) error {
+	ctx, cancel := args.Context()
+	defer cancel()
+	return this.node.TraceSuccessor(ctx, args.ID, trace)
+}
+
+func (this *RPCWrapper) NextHop(hashValue *big.Int, reply *LookupHop) error {
+	return this.node.NextHop(hashValue, reply)
 }
 
 func (this *RPCWrapper) GetSuccessor(_ int, list *[successorLen] string) error {
 	return this.node.GetSuccessor(0, list)
 }
 
-func (this *RPCWrapper) SendBackup(backup map[string] string, _ *int) error {
+func (this *RPCWrapper) SendBackup(backup ReplicaData, _ *int) error {
 	return this.node.SendBackup(backup, nil)
 }
 
-func (this *RPCWrapper) SplitIntoPredecessor(addr string, reply *map[string] string) error {
+func (this *RPCWrapper) SplitIntoPredecessor(addr string, reply *SplitReply) error {
 	return this.node.SplitIntoPredecessor(addr, reply)
 }
 
-func (this *RPCWrapper) RemoveFromBackup(backup map[string] string, _ *int) error {
+func (this *RPCWrapper) RemoveFromBackup(backup ReplicaData, _ *int) error {
 	return this.node.RemoveFromBackup(backup, nil)
 }
 
-func (this *RPCWrapper) Put(kv KVPair, ok *bool) error {
-	return this.node.Put(kv, ok)
+func (this *RPCWrapper) Put(kv KVPair, versions *Siblings) error {
+	return this.node.Put(kv, versions)
+}
+
+func (this *RPCWrapper) PutOnBackup(kv KVPair, versions *Siblings) error {
+	return this.node.PutOnBackup(kv, versions)
+}
+
+func (this *RPCWrapper) Get(key string, versions *Siblings) error {
+	return this.node.Get(key, versions)
 }
 
-func (this *RPCWrapper) PutOnBackup(kv KVPair, _ *int) error {
-	return this.node.PutOnBackup(kv, nil)
+func (this *RPCWrapper) Delete(kv KVPair, reply *DeleteReply) error {
+	return this.node.Delete(kv, reply)
 }
 
-func (this *RPCWrapper) Get(key string, value *string) error {
-	return this.node.Get(key, value)
+func (this *RPCWrapper) GetOnBackup(key string, versions *Siblings) error {
+	return this.node.GetOnBackup(key, versions)
 }
 
-func (this *RPCWrapper) Delete(key string, value *string) error {
-	return this.node.Delete(key, value)
+func (this *RPCWrapper) DeleteOnBackup(kv KVPair, reply *DeleteReply) error {
+	return this.node.DeleteOnBackup(kv, reply)
 }
 
-func (this *RPCWrapper) DeleteOnBackup(key string, _ *int) error {
-	return this.node.DeleteOnBackup(key, nil)
+func (this *RPCWrapper) GetReplicaSet(_ int, set *[]string) error {
+	return this.node.GetReplicaSet(0, set)
 }
 
-func (this *RPCWrapper) ReceiveData(_ int, data *map[string] string) error {
-	return this.node.ReceiveData(0, data)
+func (this *RPCWrapper) MerkleHashes(query MerkleQuery, hashes *[][]byte) error {
+	return this.node.MerkleHashes(query, hashes)
+}
+
+func (this *RPCWrapper) SyncBuckets(repair MerkleRepair, merged *map[string] string) error {
+	return this.node.SyncBuckets(repair, merged)
 }
 
 func (this *RPCWrapper) GetPredecessor(_ int, addr *string) error {
 	return this.node.GetPredecessor(0, addr)
 }
 
+func (this *RPCWrapper) GetPredecessors(_ int, list *[successorLen] string) error {
+	return this.node.GetPredecessors(0, list)
+}
+
+func (this *RPCWrapper) MergeData(handover ReplicaData, _ *int) error {
+	return this.node.MergeData(handover, nil)
+}
+
 func (this *RPCWrapper) Notify(addr string, _ *int) error {
 	return this.node.Notify(addr, nil)
+}
+
+func (this *RPCWrapper) TakeOver(info HandoffInfo, _ *int) error {
+	return this.node.TakeOver(info, nil)
+}
+
+func (this *RPCWrapper) Relink(info RelinkInfo, _ *int) error {
+	return this.node.Relink(info, nil)
 }
\ No newline at end of file
@@ -0,0 +1,212 @@
+package dht
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/big"
+	"time"
+)
+
+// stampedBase is the state shared by the nodes of the protocols which store
+// StampedEntry values, Kademlia and Pastry.
+type stampedBase struct {
+	address string
+	id *big.Int
+	listening bool
+	transport Transport
+	clock Clock
+	period time.Duration
+
+	data Store
+	replicas int
+	tombstoneGrace time.Duration
+	stamps stamper
+}
+
+func (this *stampedBase) base() *stampedBase {
+	return this
+}
+
+func (this *stampedBase) SetStore(data Store) {
+	this.data = data
+}
+
+func (this *stampedBase) SetClock(clock Clock) {
+	this.clock = clock
+}
+
+func (this *stampedBase) SetMaintainPeriod(period time.Duration) {
+	this.period = period
+}
+
+func (this *stampedBase) SetTombstoneGrace(grace time.Duration) {
+	this.tombstoneGrace = grace
+}
+
+// stampedNode is a node which StampedDHTNode runs.
+type stampedNode interface {
+	base() *stampedBase
+	// service returns what the node serves its RPCs through.
+	service() interface{}
+
+	SetReplicas(n int)
+	Maintain()
+	Join(addr string) error
+	Quit()
+	Clear()
+	Put(ctx context.Context, key string, value string) error
+	Get(ctx context.Context, key string) (string, error)
+	Delete(ctx context.Context, key string) error
+	Dump()
+}
+
+// StampedDHTNode offers the same API as DHTNode does over Chord, for a node of
+// a protocol storing StampedEntry values. KademliaDHTNode and PastryDHTNode
+// pick the protocol.
+type StampedDHTNode struct {
+	node stampedNode
+	listener io.Closer
+}
+
+// SetStore plugs in the store of the node. Call it before Run.
+func (this *StampedDHTNode) SetStore(data Store) {
+	this.node.base().SetStore(data)
+}
+
+func (this *StampedDHTNode) SetClock(clock Clock) {
+	this.node.base().SetClock(clock)
+}
+
+func (this *StampedDHTNode) SetMaintainPeriod(period time.Duration) {
+	this.node.base().SetMaintainPeriod(period)
+}
+
+// SetReplicas sets the number of nodes storing each key, within the bounds of
+// the protocol.
+func (this *StampedDHTNode) SetReplicas(n int) {
+	this.node.SetReplicas(n)
+}
+
+func (this *StampedDHTNode) SetTombstoneGrace(grace time.Duration) {
+	this.node.base().SetTombstoneGrace(grace)
+}
+
+func (this *StampedDHTNode) Run() {
+	node := this.node.base()
+	listener, err := node.transport.Serve(node.address, this.node.service())
+	if err != nil {
+		log.Errorf("Cannot run node at %s.\n", node.address)
+		return
+	}
+	this.listener = listener
+	node.listening = true
+	this.node.Maintain()
+	node.clock.Sleep(node.period)
+	log.Tracef("Successfully run %s.\n", node.address)
+}
+
+// Create starts a network. The node needs no state for it.
+func (this *StampedDHTNode) Create() {
+}
+
+func (this *StampedDHTNode) Join(addr string) bool {
+	node := this.node.base()
+	if err := this.node.Join(addr) ; err != nil {
+		log.Errorln("First join attempt error.", err)
+		node.clock.Sleep(node.period)
+		if err = this.node.Join(addr) ; err != nil {
+			return false
+		}
+	}
+	node.clock.Sleep(node.period)
+	return true
+}
+
+func (this *StampedDHTNode) Quit() {
+	node := this.node.base()
+	if node.listening == false {
+		return
+	}
+	this.node.Quit()
+	this.shutdown()
+	log.Tracef("Quit at node %s.\n", node.address)
+	node.clock.Sleep(node.period)
+}
+
+func (this *StampedDHTNode) ForceQuit() {
+	node := this.node.base()
+	if node.listening == false {
+		return
+	}
+	this.shutdown()
+	log.Tracef("Force quit at node %s.\n", node.address)
+	node.clock.Sleep(node.period)
+}
+
+func (this *StampedDHTNode) shutdown() {
+	this.node.base().listening = false
+	if err := this.listener.Close() ; err != nil {
+		log.Errorln(err)
+	}
+	this.node.Clear()
+}
+
+func (this *StampedDHTNode) Ping(addr string) bool {
+	return this.node.base().transport.Ping(addr)
+}
+
+func (this *StampedDHTNode) Put(key string, value string) bool {
+	return this.PutContext(context.Background(), key, value) == nil
+}
+
+func (this *StampedDHTNode) PutContext(ctx context.Context, key string, value string) error {
+	if this.node.base().listening == false {
+		return &OpError{"put", key, NotJoinedError}
+	}
+	if err := this.node.Put(ctx, key, value) ; err != nil {
+		return &OpError{"put", key, err}
+	}
+	return nil
+}
+
+func (this *StampedDHTNode) Get(key string) (bool, string) {
+	value, err := this.GetContext(context.Background(), key)
+	return err == nil, value
+}
+
+// GetContext returns NotFoundError for an absent key.
+func (this *StampedDHTNode) GetContext(ctx context.Context, key string) (string, error) {
+	if this.node.base().listening == false {
+		return "", &OpError{"get", key, NotJoinedError}
+	}
+	value, err := this.node.Get(ctx, key)
+	if err != nil {
+		return "", &OpError{"get", key, err}
+	}
+	return value, nil
+}
+
+func (this *StampedDHTNode) Delete(key string) bool {
+	return this.DeleteContext(context.Background(), key) == nil
+}
+
+// DeleteContext returns NotFoundError if no replica of the key held it.
+func (this *StampedDHTNode) DeleteContext(ctx context.Context, key string) error {
+	if this.node.base().listening == false {
+		return &OpError{"delete", key, NotJoinedError}
+	}
+	if err := this.node.Delete(ctx, key) ; err != nil {
+		return &OpError{"delete", key, err}
+	}
+	return nil
+}
+
+func (this *StampedDHTNode) Dump() {
+	node := this.node.base()
+	if node.listening == false {
+		log.Errorf("%s not listening.\n", node.address)
+		return
+	}
+	this.node.Dump()
+}
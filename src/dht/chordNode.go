@@ -1,11 +1,12 @@
 package dht
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"math/big"
-	"net/rpc"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -13,118 +14,286 @@ import (
 
 const fingerLen int = 160
 const successorLen int = 5
+const defaultReplicas int = 2
 const maintainPeriod time.Duration = 250 * time.Millisecond
-const halfMaintainPeriod time.Duration = 125 * time.Millisecond
 
 type ChordNode struct {
 	address string
 	listening bool
-
-	data map[string] string
-	dataLock sync.RWMutex
-
-	backup map[string] string
-	backupLock sync.Mutex
+	transport Transport
+	clock Clock
+	period time.Duration
+	detector *FailureDetector
+
+	data Store
+	backup Store
+	durable bool // data and backup were plugged in, and are closed on quit
+	dataLock sync.Mutex // serialises the writes to data and backup, and the moves between them
+	replicas int
+	replicaChain []string
+	readLevel, writeLevel Consistency
+	tombstoneGrace time.Duration
+	lookupMode LookupMode
 
 	successor [successorLen] string
 	succLock sync.RWMutex
-	predecessor string
+	predecessor [successorLen] string
+	handoff string // the former predecessor, while the keys since it are still to be handed over
+	predLock sync.RWMutex
 
 	finger [fingerLen] string
 	next int
+
+	members []string
+	memberCursor int
+	memberLock sync.Mutex
+
+	merkleRound uint64
+	merkleTrees map[string] *merkleCached
+	merkleLock sync.Mutex
+
+	health RingHealth
+	healthLock sync.Mutex
 }
 
-func NewChordNode(port int) *ChordNode{
+func NewChordNode(port int, transport Transport) *ChordNode{
 	localIP := GetLocalAddress()
 	return &ChordNode {
 		address : localIP + ":" + strconv.Itoa(port),
-		data : make(map[string] string),
+		transport : transport,
+		clock : DefaultClock,
+		period : maintainPeriod,
+		detector : NewFailureDetector(DefaultClock, maintainPeriod),
+		data : NewMemStore(),
+		backup : NewMemStore(),
+		replicas : defaultReplicas,
+		readLevel : defaultReadConsistency,
+		writeLevel : defaultWriteConsistency,
+		tombstoneGrace : defaultTombstoneGrace,
+		merkleTrees : make(map[string] *merkleCached),
+	}
+}
+
+// virtualNode returns the i-th virtual node of this node, with the same
+// settings but a position, fingers and stores of its own.
+func (this *ChordNode) virtualNode(i int) *ChordNode {
+	node := NewChordNode(0, this.transport)
+	node.address = virtualAddress(this.address, i)
+	node.SetClock(this.clock)
+	node.SetMaintainPeriod(this.period)
+	node.detector.Threshold = this.detector.Threshold
+	node.replicas = this.replicas
+	node.readLevel, node.writeLevel = this.readLevel, this.writeLevel
+	node.tombstoneGrace = this.tombstoneGrace
+	node.lookupMode = this.lookupMode
+	return node
+}
+
+// SetStores replaces the stores of the primary data and of the replicas.
+func (this *ChordNode) SetStores(data Store, backup Store) {
+	this.data, this.backup = data, backup
+	this.durable = true
+}
+
+// OpenStorage makes the data of the node durable in dir, recovering whatever
+// an earlier node at the same address left there.
+func (this *ChordNode) OpenStorage(dir string) error {
+	data, err := OpenFileStore(filepath.Join(dir, "data"))
+	if err != nil {
+		return err
+	}
+	backup, err := OpenFileStore(filepath.Join(dir, "backup"))
+	if err != nil {
+		data.Close()
+		return err
+	}
+	this.SetStores(data, backup)
+	log.Tracef("Node %s recovers %d keys and %d replicas from %s.\n", this.address, data.Len(), backup.Len(), dir)
+	return nil
+}
+
+// CloseStorage closes the stores plugged in by OpenStorage or SetStores,
+// leaving their content on disk, and goes on with empty ones in memory. The
+// stores the node started with are left as they are.
+func (this *ChordNode) CloseStorage() error {
+	if !this.durable {
+		return nil
+	}
+	data, backup := this.data, this.backup
+	this.data, this.backup = NewMemStore(), NewMemStore()
+	this.durable = false
+	if err := data.Close() ; err != nil {
+		backup.Close()
+		return err
 	}
+	return backup.Close()
+}
+
+func (this *ChordNode) SetClock(clock Clock) {
+	this.clock = clock
+	this.detector.clock = clock
+}
+
+func (this *ChordNode) SetMaintainPeriod(period time.Duration) {
+	this.period = period
+	this.detector.SetPeriod(period)
+}
+
+// SetSuspicionThreshold sets the phi above which a peer is taken for failed.
+// A higher threshold makes fewer mistakes but detects failures later.
+func (this *ChordNode) SetSuspicionThreshold(phi float64) {
+	this.detector.Threshold = phi
+}
+
+// Suspicion returns the phi of addr as seen by this node.
+func (this *ChordNode) Suspicion(addr string) float64 {
+	return this.detector.Phi(addr)
+}
+
+var ReplicasError error = errors.New("replication factor out of range")
+
+// maxReplicas is the largest replica set a node can keep: itself and its
+// successor list.
+const maxReplicas int = successorLen + 1
+
+// SetReplicas sets the number of nodes storing each key, from 1 to
+// maxReplicas.
+func (this *ChordNode) SetReplicas(n int) error {
+	if n < 1 || n > maxReplicas {
+		return fmt.Errorf("%w: %d, not within 1 to %d", ReplicasError, n, maxReplicas)
+	}
+	this.replicas = n
+	return nil
+}
+
+// SetConsistency sets the levels of the requests that do not give their own.
+func (this *ChordNode) SetConsistency(read, write Consistency) {
+	this.readLevel, this.writeLevel = read, write
+}
+
+// SetLookupMode sets how the lookups started by this node proceed, recursively
+// unless set.
+func (this *ChordNode) SetLookupMode(mode LookupMode) {
+	this.lookupMode = mode
+}
+
+// SetTombstoneGrace sets how long deleted keys are remembered. It should
+// exceed the time replicas may take to see a delete, or the delete may be
+// undone by anti-entropy.
+func (this *ChordNode) SetTombstoneGrace(grace time.Duration) {
+	this.tombstoneGrace = grace
 }
 
 func (this *ChordNode) Maintain() {
-	go func() {
+	this.clock.Go(func() {
 		for this.listening {
 			this.Stabilize()
-			time.Sleep(maintainPeriod)
+			this.clock.Sleep(this.period)
+		}
+	})
+	this.clock.Go(func() {
+		for this.listening {
+			this.SendHeartbeats()
+			this.clock.Sleep(this.period)
 		}
-	}()
-	go func() {
+	})
+	this.clock.Go(func() {
 		for this.listening {
 			this.CheckPredecessor()
-			time.Sleep(maintainPeriod)
+			this.HandOff()
+			this.clock.Sleep(this.period)
 		}
-	}()
-	go func() {
+	})
+	this.clock.Go(func() {
 		for this.listening {
 			this.FixFingers()
-			time.Sleep(maintainPeriod)
+			this.clock.Sleep(this.period)
+		}
+	})
+	this.clock.Go(func() {
+		for this.listening {
+			this.succLock.RLock()
+			chain := this.replicaTargets()
+			this.succLock.RUnlock()
+			this.AntiEntropy(chain)
+			this.CollectTombstones()
+			this.clock.Sleep(this.period * time.Duration(antiEntropyRounds))
 		}
-	}()
+	})
+	this.clock.Go(func() {
+		for this.listening {
+			this.clock.Sleep(this.period * time.Duration(partitionRounds))
+			this.CheckPartition()
+			this.HandOffStrays()
+		}
+	})
+	this.clock.Go(func() {
+		for round := 1 ; this.listening ; round ++ {
+			this.clock.Sleep(this.period * time.Duration(loopRounds))
+			this.RepairLoop()
+			if round % (ringWalkRounds / loopRounds) == 0 && this.walksRing() {
+				if _, err := this.CheckRing(context.Background()) ; err != nil {
+					log.Errorln("CheckRing: ", err)
+				}
+			}
+		}
+	})
 }
 
 func (this *ChordNode) Create() {
-	this.predecessor = ""
+	this.setPredecessors([successorLen] string{})
 	this.successor[0] = this.address
 }
 
 func (this *ChordNode) Join(addr string) error {
 	log.Tracef("Start to join %s.\n", this.address)
 
-	this.predecessor = ""
+	this.setPredecessors([successorLen] string{})
 	hashValue := hashString(this.address)
-	client, _ := GetClient(addr)
 
-	var err error
 	var suc string
-
-	if client == nil {
-		log.Fatalln("Join 1: null pointer.")
-	}
-
-	err = CallFunc(client, "RPCWrapper.FindSuccessor", hashValue, &suc)
-	if err != nil {
-		client.Close()
+	if this.lookupMode == Iterative {
+		var err error
+		if suc, _, err = this.IterativeLookup(context.Background(), addr, hashValue) ; err != nil {
+			return err
+		}
+	} else if err := this.transport.Call(context.Background(), addr, "RPCWrapper.FindSuccessor", LookupArgs{ID: hashValue}, &suc) ; err != nil {
 		return err
 	}
 
 	this.succLock.Lock()
 	this.successor[0] = suc
-	defer this.succLock.Unlock()
-
-	log.Tracef("Find successor of %s: %s.\n", this.address, this.successor[0])
+	this.succLock.Unlock()
 
-	client.Close()
-	client, _ = GetClient(this.successor[0])
-	defer client.Close()
+	log.Tracef("Find successor of %s: %s.\n", this.address, suc)
 
 	var list [successorLen] string
-	log.Tracef("Try to get successor list of %s from %s.\n", this.address, this.successor[0])
-	if client == nil {
-		log.Fatalln("Join 2: null pointer.")
-	}
-	err = CallFunc(client, "RPCWrapper.GetSuccessor", 0, &list)
-	if err != nil {
+	log.Tracef("Try to get successor list of %s from %s.\n", this.address, suc)
+	if err := this.transport.Call(context.Background(), suc, "RPCWrapper.GetSuccessor", 0, &list) ; err != nil {
 		this.successor[0] = this.address
 		return err
 	}
+	this.succLock.Lock()
 	for i := 1 ; i < successorLen ; i ++ {
 		this.successor[i] = list[i - 1]
 	}
+	this.succLock.Unlock()
 
 	log.Tracef("Get successor list of %s.\n", this.address)
 
-	if client == nil {
-		log.Fatalln("Join 3: null pointer.")
-	}
-	this.dataLock.Lock()
-	err = CallFunc(client, "RPCWrapper.SplitIntoPredecessor", this.address, &this.data)
-	this.dataLock.Unlock()
+	var split SplitReply
+	err := this.transport.Call(context.Background(), suc, "RPCWrapper.SplitIntoPredecessor", this.address, &split)
 	log.Tracef("Split done: %s.\n", this.address)
 	if err != nil {
 		this.successor[0] = this.address
 		return err
 	}
+	if err = this.mergeInto(this.data, split.Data) ; err != nil {
+		log.Errorln("Join: ", err)
+	}
+	if err = this.mergeInto(this.backup, split.Backup) ; err != nil {
+		log.Errorln("Join: ", err)
+	}
 
 	log.Tracef("Successfully join %s.\n", this.address)
 
@@ -138,318 +307,693 @@ func (this *ChordNode) GetSuccessor(_ int, reply *[successorLen] string) error {
 	return nil
 }
 
-func (this *ChordNode) SplitIntoPredecessor(addr string, reply *map[string] string) error {
+type SplitReply struct {
+	Data, Backup map[string] string
+}
+
+func (this *ChordNode) SplitIntoPredecessor(addr string, reply *SplitReply) error {
 	hashValue := hashString(addr)
-	this.predecessor = addr
+	this.pushPredecessor(addr)
 	this.dataLock.Lock()
-	for key, value := range this.data {
-		if !between(hashValue, hashString(key), hashString(this.address), true) {
-			(*reply)[key] = value
-			delete(this.data, key)
-		}
+	reply.Data = this.data.Range(hashString(this.address), hashValue)
+	if err := this.mergeLocked(this.backup, reply.Data) ; err != nil {
+		log.Errorln("SplitIntoPredecessor: ", err)
 	}
+	if err := this.data.DeleteAll(keysOf(reply.Data)) ; err != nil {
+		log.Errorln("SplitIntoPredecessor: ", err)
+	}
+	reply.Backup = entriesOf(this.backup)
 	this.dataLock.Unlock()
-	this.backupLock.Lock()
-	this.backup = *reply
-	this.backupLock.Unlock()
-	err := CallFuncByAddress(this.successor[0], "RPCWrapper.RemoveFromBackup", *reply, nil)
-	return err
+	if this.replicas < 2 {
+		return nil
+	}
+	// The keys now owned by addr are replicated here and on the successors
+	// addr will pick. The replicas that leave the set drop them.
+	this.succLock.RLock()
+	dropped := this.replicaTargets()
+	kept := pickReplicas(addr, append([]string{this.address}, this.successor[:]...), this.replicas - 1)
+	this.succLock.RUnlock()
+	var lastErr error
+	for _, target := range dropped {
+		if contains(kept, target) {
+			continue
+		}
+		if err := this.transport.Call(context.Background(), target, "RPCWrapper.RemoveFromBackup", ReplicaData{Owner: addr, Data: reply.Data}, nil) ; err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
-func (this *ChordNode) RemoveFromBackup(backup map[string] string, _ *int) error {
-	this.backupLock.Lock()
-	for key, _ := range backup {
-		delete(this.backup, key)
+// RemoveFromBackup drops the keys from the backup of a node which no longer
+// belongs to their replica set.
+func (this *ChordNode) RemoveFromBackup(backup ReplicaData, _ *int) error {
+	this.dataLock.Lock()
+	defer this.dataLock.Unlock()
+	return this.backup.DeleteAll(keysOf(backup.Data))
+}
+
+// LookupArgs carries a lookup from hop to hop, together with the time left
+// to the caller's deadline, if it has one.
+type LookupArgs struct {
+	ID *big.Int
+	Budget time.Duration
+	// Fingers routes the lookup by fingers and successors only, skipping the
+	// predecessor lists, see RepairLoop.
+	Fingers bool
+}
+
+func NewLookupArgs(ctx context.Context, hashValue *big.Int) LookupArgs {
+	return LookupArgs{ID: hashValue, Budget: budgetOf(ctx)}
+}
+
+// Context restores the caller's deadline on the receiving hop.
+func (this LookupArgs) Context() (context.Context, context.CancelFunc) {
+	return budgetContext(this.Budget)
+}
+
+// budgetOf returns the time left to the deadline of ctx, or zero if it has
+// none. Deadlines travel between nodes as such budgets, since their clocks
+// differ.
+func budgetOf(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline() ; ok {
+		if budget := time.Until(deadline) ; budget > 0 {
+			return budget
+		}
+		return time.Nanosecond
 	}
-	this.backupLock.Unlock()
-	return nil
+	return 0
+}
+
+// budgetContext restores a deadline received as a budget.
+func budgetContext(budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget > 0 {
+		return context.WithTimeout(context.Background(), budget)
+	}
+	return context.WithCancel(context.Background())
 }
 
 func (this *ChordNode) FindSuccessor(hashValue *big.Int, succaddr *string) error {
-	if suc := this.FirstValidSuccessor() ; between(hashString(this.address), hashValue, hashString(suc), true) {
+	return this.FindSuccessorContext(context.Background(), hashValue, succaddr)
+}
+
+func (this *ChordNode) FindSuccessorContext(ctx context.Context, hashValue *big.Int, succaddr *string) error {
+	return this.findSuccessor(ctx, NewLookupArgs(ctx, hashValue), succaddr)
+}
+
+// findSuccessor is FindSuccessorContext for a hop of a lookup, which it passes
+// on with the same arguments.
+func (this *ChordNode) findSuccessor(ctx context.Context, args LookupArgs, succaddr *string) error {
+	if err := ctx.Err() ; err != nil {
+		return err
+	}
+	if suc := this.FirstValidSuccessor() ; between(hashString(this.address), args.ID, hashString(suc), true) {
 		*succaddr = suc
 		return nil
 	}
-	jump := this.ClosestPrecedingNode(hashValue)
-	if jump == nil {
-		log.Fatalln("FindSuccessor: null pointer.")
-	} else {
-		defer jump.Close()
+	if !args.Fingers {
+		if owner := this.PrecedingOwner(args.ID) ; owner != "" {
+			*succaddr = owner
+			return nil
+		}
+	}
+	jump := this.ClosestPrecedingNode(args.ID)
+	if jump == "" {
+		return InvalidAddressError
 	}
-	return CallFunc(jump, "RPCWrapper.FindSuccessor", hashValue, succaddr)
+	next := NewLookupArgs(ctx, args.ID)
+	next.Fingers = args.Fingers
+	return this.transport.Call(ctx, jump, "RPCWrapper.FindSuccessor", next, succaddr)
 }
 
-func (this *ChordNode) ClosestPrecedingNode(hashValue *big.Int) *rpc.Client {
+func (this *ChordNode) ClosestPrecedingNode(hashValue *big.Int) string {
+	addr, _ := this.closestPrecedingFinger(hashValue)
+	return addr
+}
+
+// closestPrecedingFinger returns ClosestPrecedingNode together with which
+// finger of this node it is, or SuccessorHop.
+func (this *ChordNode) closestPrecedingFinger(hashValue *big.Int) (string, int) {
 	start := hashString(this.address)
 	for i := fingerLen - 1 ; i >= 0 ; i -- {
 		if this.finger[i] == "" || !between(start, hashString(this.finger[i]), hashValue, false) {
 			continue
 		}
-		client, err := GetClient(this.finger[i])
-		if err != nil {
+		if !this.alive(this.finger[i]) {
 			continue
 		}
-		return client
+		return this.finger[i], i
 	}
-	client, _ := GetClient(this.FirstValidSuccessor())
-	return client
+	return this.FirstValidSuccessor(), SuccessorHop
 }
 
 func (this *ChordNode) FirstValidSuccessor() string {
 	for i := 0 ; i < successorLen ; i ++ {
-		if CheckValidRPC(this.successor[i]) {
+		if this.alive(this.successor[i]) {
 			return this.successor[i]
 		}
 	}
 	return ""
 }
 
-func (this *ChordNode) SendBackup(backup map[string] string, _ *int) error {
-	this.backupLock.Lock()
-	for key, value := range backup {
-		this.backup[key] = value
+type ReplicaData struct {
+	Owner string
+	Data map[string] string
+	Remain int // the nodes MergeData may still pass keys back to
+}
+
+func (this *ChordNode) SendBackup(backup ReplicaData, _ *int) error {
+	return this.mergeInto(this.backup, backup.Data)
+}
+
+// replicate sends the data to the replica set of this node.
+func (this *ChordNode) replicate(data map[string] string) error {
+	if this.replicas < 2 || len(data) == 0 {
+		return nil
 	}
-	this.backupLock.Unlock()
-	return nil
+	this.succLock.RLock()
+	targets := this.replicaTargets()
+	this.succLock.RUnlock()
+	var lastErr error
+	for _, target := range targets {
+		if err := this.transport.Call(context.Background(), target, "RPCWrapper.SendBackup", ReplicaData{Owner: this.address, Data: data}, nil) ; err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
+// KVPair is a write of Value by Actor, the node coordinating it, on top of
+// the versions merged in Context, or a write of Versions already issued by
+// another replica.
 type KVPair struct {
 	Key, Value string
+	Actor string
+	Context VectorClock
+	Versions Siblings
 }
 
-func (this *ChordNode) PutOnChord(key string, value string) bool {
-	log.Tracef("Try to put key %s on chord.\n", key)
-	var addr string
-	err := this.FindSuccessor(hashString(key), &addr)
-	if err != nil {
-		return false
+// readVersions returns the siblings of key kept in store.
+func (this *ChordNode) readVersions(store Store, key string) (Siblings, bool) {
+	content, ok := store.Get(key)
+	if !ok {
+		return nil, false
 	}
-	var ok bool
-	log.Tracef("Get put address : %s.\n", addr)
-	err = CallFuncByAddress(addr, "RPCWrapper.Put", KVPair{Key: key, Value: value}, &ok)
-	return err == nil && ok
+	return decodeSiblings(content), true
 }
 
-func (this *ChordNode) Put(kv KVPair, ok *bool) error {
-	err := CallFuncByAddress(this.successor[0], "RPCWrapper.PutOnBackup", kv, nil)
-	if err != nil {
-		*ok = false
-		return err
+// writeVersions merges the write, or a tombstone if deleted is set, into the
+// siblings kept in store. It returns the siblings before and after the write.
+func (this *ChordNode) writeVersions(store Store, kv KVPair, deleted bool) (Siblings, Siblings, error) {
+	this.dataLock.Lock()
+	defer this.dataLock.Unlock()
+	current, _ := this.readVersions(store, kv.Key)
+	var result Siblings
+	switch {
+	case kv.Versions != nil:
+		result = mergeSiblings(current, kv.Versions)
+	case deleted:
+		if len(current.live()) == 0 {
+			return current, nil, DeleteNonExistenceError
+		}
+		// A delete removes whatever the owner holds.
+		tombstone := Sibling{Deleted: true, At: this.clock.Now().UnixNano()}
+		result = issueVersion(kv.Actor, current, tombstone, current.Context())
+	default:
+		result = issueVersion(kv.Actor, current, Sibling{Value: kv.Value}, kv.Context)
+	}
+	return current, result, store.Put(kv.Key, encodeSiblings(result))
+}
+
+// mergeInto merges transferred entries into store, keeping the versions on
+// both sides that are concurrent.
+func (this *ChordNode) mergeInto(store Store, entries map[string] string) error {
+	if len(entries) == 0 {
+		return nil
 	}
 	this.dataLock.Lock()
-	this.data[kv.Key], *ok = kv.Value, true
-	this.dataLock.Unlock()
-	return nil
+	defer this.dataLock.Unlock()
+	return this.mergeLocked(store, entries)
 }
 
-func (this *ChordNode) PutOnBackup(kv KVPair, _ *int) error {
-	this.backupLock.Lock()
-	this.backup[kv.Key] = kv.Value
-	this.backupLock.Unlock()
-	return nil
+// mergeLocked is mergeInto for a caller holding dataLock.
+func (this *ChordNode) mergeLocked(store Store, entries map[string] string) error {
+	merged := make(map[string] string, len(entries))
+	for key, content := range entries {
+		if current, ok := this.readVersions(store, key) ; ok {
+			merged[key] = encodeSiblings(mergeSiblings(current, decodeSiblings(content)))
+		} else {
+			merged[key] = content
+		}
+	}
+	return store.PutAll(merged)
+}
+
+func (this *ChordNode) PutOnChord(key string, value string) bool {
+	return this.PutOnChordContext(context.Background(), key, value) == nil
+}
+
+func (this *ChordNode) PutOnChordContext(ctx context.Context, key string, value string) error {
+	return this.PutOnReplicas(ctx, key, value, this.writeLevel)
+}
+
+// Put stores a pair on its owner and returns the versions the key has now.
+// The replicas are written by the caller, see PutOnReplicas.
+func (this *ChordNode) Put(kv KVPair, versions *Siblings) error {
+	var err error
+	_, *versions, err = this.writeVersions(this.data, kv, false)
+	return err
+}
+
+func (this *ChordNode) PutOnBackup(kv KVPair, versions *Siblings) error {
+	var err error
+	_, *versions, err = this.writeVersions(this.backup, kv, false)
+	return err
 }
 
 func (this *ChordNode) GetOnChord(key string) (bool, string) {
-	var addr string
-	err := this.FindSuccessor(hashString(key), &addr)
-	if err != nil {
-		return false, ""
+	value, err := this.GetOnChordContext(context.Background(), key)
+	return err == nil, value
+}
+
+func (this *ChordNode) GetOnChordContext(ctx context.Context, key string) (string, error) {
+	return this.GetOnReplicas(ctx, key, this.readLevel)
+}
+
+func (this *ChordNode) Get(key string, versions *Siblings) error {
+	var ok bool
+	*versions, ok = this.readVersions(this.data, key)
+	if !ok {
+		return NotFoundError
 	}
-	var value string
-	err = CallFuncByAddress(addr, "RPCWrapper.Get", key, &value)
-	return err == nil && value != "", value
+	return nil
 }
 
-func (this *ChordNode) Get(key string, value *string) error {
-	this.dataLock.RLock()
+func (this *ChordNode) GetOnBackup(key string, versions *Siblings) error {
 	var ok bool
-	*value, ok = this.data[key]
+	*versions, ok = this.readVersions(this.backup, key)
 	if !ok {
-		*value = ""
+		return NotFoundError
 	}
-	this.dataLock.RUnlock()
 	return nil
 }
 
 func (this *ChordNode) DeleteOnChord(key string) (bool, string) {
-	log.Tracef("Try to delete key %s on chord.\n", key)
-	var addr string
-	err := this.FindSuccessor(hashString(key), &addr)
-	if err != nil {
-		return false, ""
-	}
-	var value string
-	log.Tracef("Get delete address : %s.'n", addr)
-	err = CallFuncByAddress(addr, "RPCWrapper.Delete", key, &value)
+	value, err := this.DeleteOnChordContext(context.Background(), key)
 	return err == nil, value
 }
 
+func (this *ChordNode) DeleteOnChordContext(ctx context.Context, key string) (string, error) {
+	return this.DeleteOnReplicas(ctx, key, this.writeLevel)
+}
+
 var DeleteNonExistenceError error = errors.New("delete an element that doesn't exist")
 
-func (this *ChordNode) Delete(key string, value *string) error {
-	err := CallFuncByAddress(this.successor[0], "RPCWrapper.DeleteOnBackup", key, nil)
-	if err != nil {
-		return err
-	}
-	this.dataLock.Lock()
-	var ok bool
-	*value, ok = this.data[key]
-	if !ok {
-		return DeleteNonExistenceError
-	} else {
-		delete(this.data, key)
-	}
-	this.dataLock.Unlock()
-	return nil
+// DeleteReply carries the versions of a key before and after a delete.
+type DeleteReply struct {
+	Previous, Versions Siblings
 }
 
-func (this *ChordNode) DeleteOnBackup(key string, _ *int) error {
-	this.backupLock.Lock()
-	defer this.backupLock.Unlock()
-	if _, ok := this.backup[key] ; ok {
-		delete(this.backup, key)
-	} else {
-		return DeleteNonExistenceError
-	}
-	return nil
+// Delete supersedes the versions of a key on its owner with a tombstone, which
+// is kept for the grace period so that no transfer brings the old value back.
+// The replicas are written by the caller, see DeleteOnReplicas.
+func (this *ChordNode) Delete(kv KVPair, reply *DeleteReply) error {
+	var err error
+	reply.Previous, reply.Versions, err = this.writeVersions(this.data, kv, true)
+	return err
+}
+
+func (this *ChordNode) DeleteOnBackup(kv KVPair, reply *DeleteReply) error {
+	var err error
+	reply.Previous, reply.Versions, err = this.writeVersions(this.backup, kv, true)
+	return err
 }
 
 func (this *ChordNode) Stabilize() {
 	log.Tracef("Stabilize at %s.\n", this.address)
 	defer log.Tracef("Stabilization at %s ends.\n", this.address)
+	this.succLock.RLock()
+	first := this.successor[0]
+	this.succLock.RUnlock()
 	suc := this.FirstValidSuccessor()
 	log.Tracef("first valid successor: %s.\n", suc)
-	client, err := GetClient(suc)
-	if err != nil {
-		return
+	if suc == "" {
+		if suc = this.closestLiveNode() ; suc == "" {
+			return
+		}
+		log.Warningf("Node %s has lost its successor list, and falls back to %s.\n", this.address, suc)
 	}
 	var addr string
-	if client == nil {
-		log.Fatalln("Stabilize 1: null pointer.")
-	}
-	err_ := CallFunc(client, "RPCWrapper.GetPredecessor", 0, &addr)
+	err := this.transport.Call(context.Background(), suc, "RPCWrapper.GetPredecessor", 0, &addr)
 	log.Tracef("predecessor: %s.\n", addr)
-	if err_ != nil {
-		err_ = CallFunc(client, "RPCWrapper.GetPredecessor", 0, &addr)
-	}
-	if err_ == nil {
-		if addr != "" && between(hashString(this.address), hashString(addr), hashString(suc), false) {
-			client.Close()
-			client, err = GetClient(addr)
-			if err != nil {
-				client, err = GetClient(suc)
-				addr = ""
-				if err != nil {
-					return
-				}
-			}
-		} else {
-			addr = ""
+	if err != nil {
+		err = this.transport.Call(context.Background(), suc, "RPCWrapper.GetPredecessor", 0, &addr)
+	}
+	if err == nil {
+		if addr != "" && between(hashString(this.address), hashString(addr), hashString(suc), false) && this.alive(addr) {
+			suc = addr
 		}
 	} else {
-		log.Errorln("Stabilize1: ", err_)
-	}
-	if client == nil {
-		log.Fatalln("Stabilize 2: null pointer.")
+		log.Errorln("Stabilize1: ", err)
 	}
 	var list [successorLen] string
-	err = CallFunc(client, "RPCWrapper.GetSuccessor", 0, &list)
-	if err != nil {
+	if err = this.transport.Call(context.Background(), suc, "RPCWrapper.GetSuccessor", 0, &list) ; err != nil {
 		log.Errorln("Stabilize2: ", err)
-		client.Close()
 		return
 	}
 	this.succLock.Lock()
-	if addr != "" {
-		this.successor[0] = addr
-		log.Tracef("The successor of node %s has been changed to %s.\n", this.address, addr)
-	} else {
-		this.successor[0] = suc
-		log.Tracef("The successor of node %s has been changed to %s.\n", this.address, suc)
+	if this.successor[0] != first {
+		// Join or Relink has replaced the successor in the meantime.
+		this.succLock.Unlock()
+		return
 	}
+	this.successor[0] = suc
+	log.Tracef("The successor of node %s has been changed to %s.\n", this.address, suc)
 	for i := 1 ; i < successorLen ; i ++ {
 		this.successor[i] = list[i - 1]
 	}
-	if client == nil {
-		log.Fatalln("Stabilize 3: null pointer.")
+	chain := this.replicaTargets()
+	this.succLock.Unlock()
+	if err = this.transport.Call(context.Background(), suc, "RPCWrapper.Notify", this.address, nil) ; err != nil {
+		log.Errorln("Stabilize3: ", err)
 	}
-	err_ = CallFunc(client, "RPCWrapper.Notify", this.address, nil)
-	if err_ != nil {
-		log.Errorln("Stabilize3: ", err_)
+	this.refreshReplicas(chain)
+}
+
+// replicaTargets returns the successors expected to hold replicas of the local
+// data, see pickReplicas. The caller must hold succLock.
+func (this *ChordNode) replicaTargets() []string {
+	return pickReplicas(this.address, this.successor[:], this.replicas - 1)
+}
+
+// pickReplicas returns the first count candidates, skipping those on the host
+// of owner or of a candidate picked before, so that a host failing takes at
+// most one copy of a key with it. With fewer hosts than count, fewer are
+// picked.
+func pickReplicas(owner string, candidates []string, count int) []string {
+	host, _ := splitAddress(owner)
+	hosts := map[string] bool{host: true}
+	chain := make([]string, 0, count)
+	for _, addr := range candidates {
+		if len(chain) == count {
+			break
+		}
+		if addr == "" {
+			continue
+		}
+		host, _ := splitAddress(addr)
+		if hosts[host] {
+			continue
+		}
+		hosts[host] = true
+		chain = append(chain, addr)
+	}
+	return chain
+}
+
+// refreshReplicas runs anti-entropy at once when the set of replica holders has
+// changed, so that every key keeps its copies.
+func (this *ChordNode) refreshReplicas(chain []string) {
+	if len(chain) == len(this.replicaChain) {
+		same := true
+		for i := range chain {
+			if chain[i] != this.replicaChain[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	if this.AntiEntropy(chain) {
+		this.replicaChain = chain
 	}
-	this.succLock.Unlock()
-	client.Close()
 }
 
 func (this *ChordNode) Notify(addr string, _ *int) error {
-	if this.predecessor == "" || this.predecessor != addr && between(hashString(this.predecessor), hashString(addr), hashString(this.address), true) {
-		log.Tracef("The predecessor of node %s has been changed from %s to %s.\n", this.address, this.predecessor, addr)
-		this.predecessor = addr
-		err := CallFuncByAddress(addr, "RPCWrapper.ReceiveData", 0, &this.backup)
-		if err != nil {
-			log.Errorln("Notify: ", err)
+	this.detector.Heartbeat(addr)
+	this.remember(addr)
+	pred := this.firstPredecessor()
+	if pred == "" || pred != addr && between(hashString(pred), hashString(addr), hashString(this.address), true) {
+		log.Tracef("The predecessor of node %s has been changed from %s to %s.\n", this.address, pred, addr)
+		if pred == "" {
+			this.EnableBackup(addr)
+		}
+		this.pushPredecessor(addr)
+		if pred != "" {
+			this.predLock.Lock()
+			if this.handoff == "" {
+				this.handoff = pred
+			}
+			this.predLock.Unlock()
 		}
 	}
 	return nil
 }
 
-func (this *ChordNode) ReceiveData(_ int, data *map[string] string) error {
-	this.dataLock.Lock()
-	*data = this.data
-	this.dataLock.Unlock()
+func (this *ChordNode) GetPredecessor(_ int, addr *string) error {
+	*addr = this.firstPredecessor()
 	return nil
 }
 
-func (this *ChordNode) GetPredecessor(_ int, addr *string) error {
-	*addr = this.predecessor
+// GetPredecessors returns the predecessor list, the closest first.
+func (this *ChordNode) GetPredecessors(_ int, reply *[successorLen] string) error {
+	this.predLock.RLock()
+	*reply = this.predecessor
+	this.predLock.RUnlock()
 	return nil
 }
 
+func (this *ChordNode) firstPredecessor() string {
+	this.predLock.RLock()
+	defer this.predLock.RUnlock()
+	return this.predecessor[0]
+}
+
+func (this *ChordNode) setPredecessors(list [successorLen] string) {
+	this.predLock.Lock()
+	this.predecessor = list
+	this.predLock.Unlock()
+}
+
+// pushPredecessor makes addr the predecessor, the former ones following it.
+func (this *ChordNode) pushPredecessor(addr string) {
+	this.predLock.Lock()
+	defer this.predLock.Unlock()
+	if this.predecessor[0] == addr {
+		return
+	}
+	for i := successorLen - 1 ; i > 0 ; i -- {
+		this.predecessor[i] = this.predecessor[i - 1]
+	}
+	this.predecessor[0] = addr
+}
+
+// CheckPredecessor keeps the predecessor list up to date from the predecessor,
+// as Stabilize does with the successor list. Once the predecessor fails, the
+// next live node of the list takes its place at once, and the node takes over
+// the keys between them without waiting for a Notify.
 func (this *ChordNode) CheckPredecessor() {
-	if this.predecessor != "" && !CheckValidRPC(this.predecessor) {
-		log.Warningf("Node %s, predecessor of node %s, has failed.\n", this.predecessor, this.address)
-		this.EnableBackup()
-		this.predecessor = ""
+	this.predLock.RLock()
+	list := this.predecessor
+	this.predLock.RUnlock()
+	if list[0] == "" {
+		return
+	}
+	if this.alive(list[0]) {
+		var further [successorLen] string
+		if err := this.transport.Call(context.Background(), list[0], "RPCWrapper.GetPredecessors", 0, &further) ; err != nil {
+			log.Errorln("CheckPredecessor: ", err)
+			return
+		}
+		this.predLock.Lock()
+		if this.predecessor[0] == list[0] {
+			for i := 1 ; i < successorLen ; i ++ {
+				this.predecessor[i] = further[i - 1]
+			}
+		}
+		this.predLock.Unlock()
+		return
+	}
+	log.Warningf("Node %s, predecessor of node %s, has failed.\n", list[0], this.address)
+	var rest [successorLen] string
+	for i := 1 ; i < successorLen ; i ++ {
+		if list[i] == "" || list[i] == this.address {
+			break
+		}
+		if !this.alive(list[i]) {
+			continue
+		}
+		copy(rest[:], list[i :])
+		break
+	}
+	this.predLock.Lock()
+	if this.predecessor[0] != list[0] {
+		// Notify has replaced the predecessor in the meantime.
+		this.predLock.Unlock()
+		return
+	}
+	this.predecessor = rest
+	this.predLock.Unlock()
+	if rest[0] != "" {
+		log.Tracef("The predecessor of node %s falls back to %s.\n", this.address, rest[0])
+		this.EnableBackup(rest[0])
+	}
+}
+
+// PrecedingOwner returns the owner of the ID if it lies counter-clockwise of
+// this node, within its predecessor list: this node for the keys it owns, or
+// the predecessor whose range holds the ID, unless the failure detector
+// suspects it. The list is trusted as maintained, without asking the
+// predecessor, so that lookups make no extra call; a node which just joined
+// is missed until the next maintenance round, as with successors. It returns
+// "" if the ID is further away.
+func (this *ChordNode) PrecedingOwner(hashValue *big.Int) string {
+	this.predLock.RLock()
+	list := this.predecessor
+	this.predLock.RUnlock()
+	if list[0] == "" {
+		return ""
+	}
+	if between(hashString(list[0]), hashValue, hashString(this.address), true) {
+		return this.address
+	}
+	for i := 0 ; i + 1 < successorLen ; i ++ {
+		if list[i + 1] == "" || list[i + 1] == this.address {
+			break
+		}
+		if !between(hashString(list[i + 1]), hashValue, hashString(list[i]), true) {
+			continue
+		}
+		if this.detector.Suspected(list[i]) {
+			break
+		}
+		return list[i]
 	}
+	return ""
 }
 
-func (this *ChordNode) EnableBackup() {
-	this.backupLock.Lock()
+// EnableBackup promotes the replicas of keys in (pred, this] once the former
+// predecessors have failed, and replicates them further down the ring.
+func (this *ChordNode) EnableBackup(pred string) {
 	this.dataLock.Lock()
-	for key, value := range this.backup {
-		this.data[key] = value
+	promoted := this.backup.Range(hashString(pred), hashString(this.address))
+	if err := this.mergeLocked(this.data, promoted) ; err != nil {
+		this.dataLock.Unlock()
+		log.Errorln("EnableBackup: ", err)
+		return
 	}
-	this.dataLock.Unlock()
-	client, err := GetClient(this.FirstValidSuccessor())
-	if err == nil {
-		if client == nil {
-			log.Fatalln("EnableBackup: null pointer.")
-		}
-		err = CallFunc(client, "RPCWrapper.SendBackup", this.backup, nil)
-		client.Close()
+	if err := this.backup.DeleteAll(keysOf(promoted)) ; err != nil {
+		log.Errorln("EnableBackup: ", err)
 	}
-	if err != nil {
+	this.dataLock.Unlock()
+	log.Tracef("Node %s promotes %d backup keys.\n", this.address, len(promoted))
+	if err := this.replicate(promoted) ; err != nil {
 		log.Errorln("EnableBackup: ", err)
 	}
-	this.backup = make(map[string] string)
-	this.backupLock.Unlock()
 }
 
 func (this *ChordNode) FixFingers() {
-	err := this.FindSuccessor(jump(this.address, this.next), &this.finger[this.next])
+	err := this.lookup(context.Background(), jump(this.address, this.next), &this.finger[this.next])
 	if err != nil {
 		log.Errorln("FixFingers: ", err)
 	}
 	this.next = (this.next + 1) % fingerLen
 }
 
-func (this *ChordNode) Clear() {
+type HandoffInfo struct {
+	From string
+	Predecessor [successorLen] string
+	Data, Backup map[string] string
+}
+
+type RelinkInfo struct {
+	From string
+	Successor [successorLen] string
+}
+
+func (this *ChordNode) Quit() error {
+	suc := this.FirstValidSuccessor()
+	if suc == "" || suc == this.address {
+		log.Tracef("Node %s quits as the last node of the ring.\n", this.address)
+		return nil
+	}
+	info := HandoffInfo{From: this.address}
+	this.GetPredecessors(0, &info.Predecessor)
+	info.Data, info.Backup = entriesOf(this.data), entriesOf(this.backup)
+	if err := this.transport.Call(context.Background(), suc, "RPCWrapper.TakeOver", info, nil) ; err != nil {
+		return err
+	}
+	if pred := info.Predecessor[0] ; pred != "" && pred != this.address {
+		relink := RelinkInfo{From: this.address}
+		this.succLock.RLock()
+		relink.Successor = this.successor
+		this.succLock.RUnlock()
+		if relink.Successor[0] != suc {
+			for i := successorLen - 1 ; i > 0 ; i -- {
+				relink.Successor[i] = relink.Successor[i - 1]
+			}
+			relink.Successor[0] = suc
+		}
+		if err := this.transport.Call(context.Background(), pred, "RPCWrapper.Relink", relink, nil) ; err != nil {
+			return err
+		}
+	}
+	log.Tracef("Node %s has handed its data over to %s.\n", this.address, suc)
+	return nil
+}
+
+func (this *ChordNode) TakeOver(info HandoffInfo, _ *int) error {
 	this.dataLock.Lock()
-	this.data = make(map[string] string)
+	if err := this.mergeLocked(this.data, info.Data) ; err != nil {
+		this.dataLock.Unlock()
+		return err
+	}
+	if err := this.backup.Clear() ; err != nil {
+		log.Errorln("TakeOver: ", err)
+	}
+	if err := this.backup.PutAll(info.Backup) ; err != nil {
+		log.Errorln("TakeOver: ", err)
+	}
 	this.dataLock.Unlock()
-	this.backupLock.Lock()
-	this.backup = make(map[string] string)
-	this.backupLock.Unlock()
+	if pred := info.Predecessor[0] ; pred == info.From || pred == this.address {
+		this.setPredecessors([successorLen] string{})
+	} else {
+		this.setPredecessors(info.Predecessor)
+	}
+	log.Tracef("Node %s takes over the data of %s.\n", this.address, info.From)
+	if err := this.replicate(info.Data) ; err != nil {
+		log.Errorln("TakeOver: ", err)
+	}
+	return nil
+}
+
+func (this *ChordNode) Relink(info RelinkInfo, _ *int) error {
+	this.succLock.Lock()
+	defer this.succLock.Unlock()
+	if this.successor[0] != info.From {
+		return nil
+	}
+	for i := 0 ; i < successorLen ; i ++ {
+		if info.Successor[i] == info.From {
+			info.Successor[i] = this.address
+		}
+	}
+	this.successor = info.Successor
+	log.Tracef("The successor of node %s has been relinked from %s to %s.\n", this.address, info.From, this.successor[0])
+	return nil
+}
+
+func (this *ChordNode) Clear() {
+	this.dataLock.Lock()
+	defer this.dataLock.Unlock()
+	if err := this.data.Clear() ; err != nil {
+		log.Errorln("Clear: ", err)
+	}
+	if err := this.backup.Clear() ; err != nil {
+		log.Errorln("Clear: ", err)
+	}
 }
 
 func (this *ChordNode) Dump() {
@@ -457,13 +1001,15 @@ func (this *ChordNode) Dump() {
 	fmt.Printf("Predecessor: %s\n", this.predecessor)
 	fmt.Printf("Successor: %s\n", this.successor)
 	fmt.Print("Data: {")
-	for key, value := range this.data {
-		fmt.Printf("{%s: %s}, ", key, value)
-	}
+	this.data.Iterate(func(key string, content string) bool {
+		fmt.Printf("{%s: %s}, ", key, decodeSiblings(content).Values())
+		return true
+	})
 	fmt.Printf("}\n")
 	fmt.Print("Backup: {")
-	for key, value := range this.backup {
-		fmt.Printf("{%s: %s}, ", key, value)
-	}
+	this.backup.Iterate(func(key string, content string) bool {
+		fmt.Printf("{%s: %s}, ", key, decodeSiblings(content).Values())
+		return true
+	})
 	fmt.Printf("}\n")
 }
\ No newline at end of file
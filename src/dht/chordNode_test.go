@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestPickReplicas(t *testing.T) {
+	tests := []struct {
+		name string
+		owner string
+		candidates []string
+		count int
+		want []string
+	}{
+		{"distinct hosts", "a:1", []string{"b:1", "c:1", "d:1"}, 2, []string{"b:1", "c:1"}},
+		{"virtual nodes of the owner", "a:1#0", []string{"a:1#1", "b:1", "a:1#2", "c:1"}, 2, []string{"b:1", "c:1"}},
+		{"virtual nodes of a replica", "a:1", []string{"b:1#0", "b:1#1", "c:1"}, 2, []string{"b:1#0", "c:1"}},
+		{"too few hosts", "a:1", []string{"b:1", "a:1#1", "b:1#1", ""}, 3, []string{"b:1"}},
+		{"gaps", "a:1", []string{"", "b:1", "", "c:1"}, 2, []string{"b:1", "c:1"}},
+		{"none wanted", "a:1", []string{"b:1"}, 0, []string{}},
+	}
+	for _, test := range tests {
+		if got := pickReplicas(test.owner, test.candidates, test.count) ; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPrecedingOwner(t *testing.T) {
+	nodes := newTestRing(t, NewMemNetwork(), 8)
+	node := nodes[4]
+	tests := []struct {
+		name string
+		id *big.Int
+		down int
+		want string
+	}{
+		{name : "own key", id : hashString(node.address), down : -1, want : node.address},
+		{name : "predecessor", id : hashString(nodes[3].address), down : -1, want : nodes[3].address},
+		{name : "within the list", id : new(big.Int).Sub(hashString(nodes[1].address), big.NewInt(1)), down : -1, want : nodes[1].address},
+		{name : "suspected owner", id : hashString(nodes[2].address), down : 2, want : ""},
+		{name : "past the list", id : hashString(nodes[6].address), down : -1, want : ""},
+	}
+	for _, test := range tests {
+		if test.down >= 0 {
+			node.detector.Down(nodes[test.down].address)
+		}
+		if got := node.PrecedingOwner(test.id) ; got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if test.down >= 0 {
+			node.detector.Heartbeat(nodes[test.down].address)
+		}
+	}
+}
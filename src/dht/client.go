@@ -0,0 +1,167 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client reads and writes a ring from outside it. It neither joins the ring
+// nor keeps any data, so that short-lived processes may use the DHT without
+// churning it: keys are looked up through the seed nodes, and requests go to
+// the replicas of each key directly. Its writes are versioned in the name of
+// an actor of its own, random for each client unless set, see SetActor.
+type Client struct {
+	transport Transport
+	clock Clock
+	seeds []string
+	actor string
+	readLevel, writeLevel Consistency
+
+	first int
+	lock sync.Mutex
+}
+
+// NewClient returns a client of the ring the seeds belong to. Any of them will
+// do; the others are tried in turn while one does not answer.
+func NewClient(transport Transport, seeds ...string) *Client {
+	return &Client{
+		transport : transport,
+		clock : DefaultClock,
+		seeds : append([]string(nil), seeds...),
+		actor : newClientActor(),
+		readLevel : defaultReadConsistency,
+		writeLevel : defaultWriteConsistency,
+	}
+}
+
+// newClientActor returns a random name for the versions a client issues. The
+// replica issuing them may be any of the replica set, so that a name shared
+// with a node or another client could see the same counter given out twice,
+// and one of the writes dropped as a duplicate.
+func newClientActor() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id) ; err != nil {
+		log.Warningf("newClientActor: %s.\n", err)
+		return "client-" + strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return "client-" + hex.EncodeToString(id)
+}
+
+func (this *Client) SetClock(clock Clock) {
+	this.clock = clock
+}
+
+// SetActor sets the name the writes of the client are versioned in. A process
+// which runs again and again should keep one name across its runs, as each
+// name stays in the vector clocks of the keys it wrote; the name must still be
+// its own, see newClientActor.
+func (this *Client) SetActor(actor string) {
+	this.actor = actor
+}
+
+// SetConsistency sets the levels of Put, Get and Delete, which are ONE for
+// reads and ALL for writes unless set.
+func (this *Client) SetConsistency(read, write Consistency) {
+	this.readLevel, this.writeLevel = read, write
+}
+
+// replicaClient runs the requests of the client, in the name of its own actor.
+func (this *Client) replicaClient() *replicaClient {
+	return &replicaClient{transport: this.transport, clock: this.clock, actor: this.actor, lookup: this.findSuccessor}
+}
+
+// findSuccessor looks the ID up through the first seed that answers, which is
+// tried first next time.
+func (this *Client) findSuccessor(ctx context.Context, hashValue *big.Int, succaddr *string) error {
+	this.lock.Lock()
+	first := this.first
+	this.lock.Unlock()
+	err := NoRouteError
+	for i := range this.seeds {
+		seed := (first + i) % len(this.seeds)
+		err = this.transport.Call(ctx, this.seeds[seed], "RPCWrapper.FindSuccessor", NewLookupArgs(ctx, hashValue), succaddr)
+		if err == nil {
+			this.lock.Lock()
+			this.first = seed
+			this.lock.Unlock()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Lookup returns the owner of the key.
+func (this *Client) Lookup(ctx context.Context, key string) (string, error) {
+	var owner string
+	if err := this.findSuccessor(ctx, hashString(key), &owner) ; err != nil {
+		return "", &OpError{"lookup", key, lookupError(err)}
+	}
+	return owner, nil
+}
+
+func (this *Client) Put(ctx context.Context, key string, value string) error {
+	return this.PutConsistent(ctx, key, value, this.writeLevel)
+}
+
+// PutConsistent returns once w replicas of the key hold the value.
+func (this *Client) PutConsistent(ctx context.Context, key string, value string, w Consistency) error {
+	if err := this.replicaClient().PutOnReplicas(ctx, key, value, w) ; err != nil {
+		return &OpError{"put", key, err}
+	}
+	return nil
+}
+
+// Get returns NotFoundError for an absent key, and ConflictError if the key has
+// concurrent versions.
+func (this *Client) Get(ctx context.Context, key string) (string, error) {
+	return this.GetConsistent(ctx, key, this.readLevel)
+}
+
+// GetConsistent reads the key from r of its replicas.
+func (this *Client) GetConsistent(ctx context.Context, key string, r Consistency) (string, error) {
+	value, err := this.replicaClient().GetOnReplicas(ctx, key, r)
+	if err != nil {
+		return "", &OpError{"get", key, err}
+	}
+	return value, nil
+}
+
+// GetVersions returns the concurrent versions of the key held by r of its
+// replicas, for the caller to resolve with Resolve.
+func (this *Client) GetVersions(ctx context.Context, key string, r Consistency) (Siblings, error) {
+	versions, err := this.replicaClient().GetVersionsOnReplicas(ctx, key, r)
+	if err != nil {
+		return nil, &OpError{"get", key, err}
+	}
+	return versions, nil
+}
+
+// Resolve writes value as the successor of the versions merged in seen.
+func (this *Client) Resolve(ctx context.Context, key string, value string, seen VectorClock, w Consistency) error {
+	if err := this.replicaClient().PutVersionOnReplicas(ctx, key, value, seen, w) ; err != nil {
+		return &OpError{"resolve", key, err}
+	}
+	return nil
+}
+
+func (this *Client) Delete(ctx context.Context, key string) error {
+	return this.DeleteConsistent(ctx, key, this.writeLevel)
+}
+
+// DeleteConsistent returns once w replicas of the key have dropped it. Deleting
+// an absent key returns NotFoundError.
+func (this *Client) DeleteConsistent(ctx context.Context, key string, w Consistency) error {
+	if _, err := this.replicaClient().DeleteOnReplicas(ctx, key, w) ; err != nil {
+		return &OpError{"delete", key, err}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// resolveRuns has a client run several times, each run reading the key and
+// writing a value of its own over what it read. It returns the versions left,
+// or reports and returns nil. Failing the test from a simulated goroutine
+// would block the simulator.
+func resolveRuns(t *testing.T, newClient func(actor string) *Client, actor string, runs int) Siblings {
+	ctx := context.Background()
+	for run := 0 ; run < runs ; run ++ {
+		client := newClient(actor)
+		versions, err := client.GetVersions(ctx, "job", All)
+		if err != nil && !errors.Is(err, NotFoundError) {
+			t.Error(err)
+			return nil
+		}
+		if err := client.Resolve(ctx, "job", "run" + strconv.Itoa(run), versions.Context(), All) ; err != nil {
+			t.Error(err)
+			return nil
+		}
+	}
+	versions, err := newClient(actor).GetVersions(ctx, "job", All)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return versions
+}
+
+func TestClient(t *testing.T) {
+	tests := []struct {
+		name string
+		run func(t *testing.T, newClient func(actor string) *Client)
+	}{
+		{
+			name : "put, get and delete",
+			run : func(t *testing.T, newClient func(actor string) *Client) {
+				ctx := context.Background()
+				client := newClient("")
+				if err := client.Put(ctx, "key", "value") ; err != nil {
+					t.Error(err)
+					return
+				}
+				if value, err := client.Get(ctx, "key") ; err != nil || value != "value" {
+					t.Errorf("get got %q, %v; want value", value, err)
+				}
+				if err := client.Delete(ctx, "key") ; err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := client.Get(ctx, "key") ; !errors.Is(err, NotFoundError) {
+					t.Errorf("get after delete got %v, want NotFoundError", err)
+				}
+				if err := client.Delete(ctx, "key") ; !errors.Is(err, NotFoundError) {
+					t.Errorf("second delete got %v, want NotFoundError", err)
+				}
+			},
+		},
+		{
+			name : "conflict resolved",
+			run : func(t *testing.T, newClient func(actor string) *Client) {
+				ctx := context.Background()
+				alice, bob := newClient("alice"), newClient("bob")
+				if err := alice.Put(ctx, "key", "base") ; err != nil {
+					t.Error(err)
+					return
+				}
+				// Both write over the version they read.
+				read, err := alice.GetVersions(ctx, "key", All)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := alice.Resolve(ctx, "key", "a", read.Context(), All) ; err != nil {
+					t.Error(err)
+					return
+				}
+				if err := bob.Resolve(ctx, "key", "b", read.Context(), All) ; err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := alice.Get(ctx, "key") ; !errors.Is(err, ConflictError) {
+					t.Errorf("get of concurrent writes got %v, want ConflictError", err)
+					return
+				}
+				versions, err := bob.GetVersions(ctx, "key", All)
+				if err != nil || len(versions.Values()) != 2 {
+					t.Errorf("got versions %v, %v; want a and b", versions.Values(), err)
+					return
+				}
+				if err := bob.Resolve(ctx, "key", "ab", versions.Context(), All) ; err != nil {
+					t.Error(err)
+					return
+				}
+				if value, err := alice.Get(ctx, "key") ; err != nil || value != "ab" {
+					t.Errorf("get after resolve got %q, %v; want ab", value, err)
+				}
+			},
+		},
+		{
+			name : "one actor across runs",
+			run : func(t *testing.T, newClient func(actor string) *Client) {
+				versions := resolveRuns(t, newClient, "job-runner", 3)
+				if len(versions) != 1 || len(versions.Context()) != 1 {
+					t.Errorf("got versions %v, want one with a single actor", versions)
+				}
+			},
+		},
+		{
+			// Each run of a client left to its random actor adds one.
+			name : "an actor per run",
+			run : func(t *testing.T, newClient func(actor string) *Client) {
+				versions := resolveRuns(t, newClient, "", 3)
+				if len(versions) != 1 || len(versions.Context()) != 3 {
+					t.Errorf("got versions %v, want one with three actors", versions)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := NewSimulator(1)
+			sim.Run(func() {
+				nodes := newSimRing(t, sim, 4)
+				test.run(t, func(actor string) *Client {
+					client := NewClient(sim, nodes[0].node.address)
+					client.SetClock(sim)
+					if actor != "" {
+						client.SetActor(actor)
+					}
+					return client
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time and concurrency of a node. The simulator
+// replaces it to replay a run exactly.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	Go(f func())
+	// Wait blocks until done is closed or, if timeout is positive, until
+	// timeout has passed, and tells whether done was closed.
+	Wait(done <-chan struct{}, timeout time.Duration) bool
+}
+
+type realClock struct{}
+
+var DefaultClock Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) Go(f func()) {
+	go f()
+}
+
+func (realClock) Wait(done <-chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		<- done
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <- done :
+		return true
+	case <- timer.C :
+		return false
+	}
+}
+
+// parallel runs the calls at once and returns when all are done.
+func parallel(clock Clock, calls []func()) {
+	if len(calls) == 0 {
+		return
+	}
+	done := make(chan struct{})
+	var lock sync.Mutex
+	pending := len(calls)
+	for _, call := range calls {
+		call := call
+		clock.Go(func() {
+			call()
+			lock.Lock()
+			defer lock.Unlock()
+			if pending -- ; pending == 0 {
+				close(done)
+			}
+		})
+	}
+	clock.Wait(done, 0)
+}
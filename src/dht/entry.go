@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// StampedEntry is a value as the Kademlia and Pastry nodes store it. The write
+// with the latest At wins, and a delete writes a tombstone.
+type StampedEntry struct {
+	Value string
+	At int64
+	Deleted bool `json:",omitempty"`
+}
+
+// supersedes breaks ties between writes of the same time in favour of deletes,
+// then of the greater value, so that every node keeps the same one.
+func (this StampedEntry) supersedes(other StampedEntry) bool {
+	switch {
+	case this.At != other.At:
+		return this.At > other.At
+	case this.Deleted != other.Deleted:
+		return this.Deleted
+	}
+	return this.Value > other.Value
+}
+
+// stamper issues the At of the writes of a node. It takes the time of the
+// node's clock, unless the node has already seen a write stamped as late, in
+// which case it takes the next nanosecond: a node whose clock runs behind then
+// still writes after every write it knows of, instead of losing to them.
+type stamper struct {
+	latest int64
+	lock sync.Mutex
+}
+
+// observe records a stamp seen on an entry.
+func (this *stamper) observe(at int64) {
+	this.lock.Lock()
+	if at > this.latest {
+		this.latest = at
+	}
+	this.lock.Unlock()
+}
+
+// next returns a stamp later than every stamp observed, and than current, the
+// stamp of the entry the write replaces.
+func (this *stamper) next(now time.Time, current int64) int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if current > this.latest {
+		this.latest = current
+	}
+	at := now.UnixNano()
+	if at <= this.latest {
+		at = this.latest + 1
+	}
+	this.latest = at
+	return at
+}
+
+func encodeEntry(entry StampedEntry) string {
+	content, _ := json.Marshal(entry)
+	return string(content)
+}
+
+func decodeEntry(content string) StampedEntry {
+	var entry StampedEntry
+	if json.Unmarshal([]byte(content), &entry) != nil {
+		return StampedEntry{Value: content}
+	}
+	return entry
+}
@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStamperNext(t *testing.T) {
+	tests := []struct {
+		name string
+		observed int64
+		now int64
+		current int64
+		want int64
+	}{
+		{"clock ahead", 100, 200, 150, 200},
+		{"clock behind a stamp observed", 300, 200, 0, 301},
+		{"clock behind the entry replaced", 0, 200, 500, 501},
+		{"clock equal to a stamp", 200, 200, 0, 201},
+	}
+	for _, test := range tests {
+		var stamps stamper
+		stamps.observe(test.observed)
+		if got := stamps.next(time.Unix(0, test.now), test.current) ; got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStamperIncreases(t *testing.T) {
+	var stamps stamper
+	now := time.Unix(0, 1000)
+	last := int64(0)
+	for i := 0 ; i < 3 ; i ++ {
+		at := stamps.next(now, 0)
+		if at <= last {
+			t.Fatalf("stamp %d after %d", at, last)
+		}
+		last = at
+	}
+}
+
+func TestSupersedes(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b StampedEntry
+		want bool
+	}{
+		{"later", StampedEntry{Value: "a", At: 2}, StampedEntry{Value: "b", At: 1}, true},
+		{"earlier", StampedEntry{Value: "a", At: 1}, StampedEntry{Value: "b", At: 2}, false},
+		{"tie goes to the delete", StampedEntry{Deleted: true, At: 1}, StampedEntry{Value: "b", At: 1}, true},
+		{"tie goes to the greater value", StampedEntry{Value: "b", At: 1}, StampedEntry{Value: "a", At: 1}, true},
+		{"equal", StampedEntry{Value: "a", At: 1}, StampedEntry{Value: "a", At: 1}, false},
+	}
+	for _, test := range tests {
+		if got := test.a.supersedes(test.b) ; got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
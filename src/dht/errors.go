@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"strings"
+)
+
+var NotFoundError error = errors.New("key not found")
+var NoRouteError error = errors.New("no route to the owner")
+var NotJoinedError error = errors.New("node not listening")
+var ReplicaWriteError error = errors.New("replica write failed")
+
+// OpError is returned by Client and by the client API of DHTNode,
+// KademliaDHTNode and PastryDHTNode. Test the cause with errors.Is against
+// NotFoundError, TimeOutError, NoRouteError, NotJoinedError, ReplicaWriteError,
+// QuorumError or ConflictError.
+type OpError struct {
+	Op, Key string
+	Err error
+}
+
+func (this *OpError) Error() string {
+	return this.Op + " " + this.Key + ": " + this.Err.Error()
+}
+
+func (this *OpError) Unwrap() error {
+	return this.Err
+}
+
+// knownErrors may come back from a remote node as a plain rpc.ServerError.
+var knownErrors = []error{
+	NotFoundError, DeleteNonExistenceError, NoRouteError, NotJoinedError, ReplicaWriteError, QuorumError,
+	ConflictError, TimeOutError, InvalidAddressError, UnreachableError,
+}
+
+// remoteError turns a server error carrying the text of one of the known errors
+// back into that error, so that it survives the trip over the transport.
+func remoteError(err error) error {
+	var serverError rpc.ServerError
+	if !errors.As(err, &serverError) {
+		return err
+	}
+	msg := string(serverError)
+	for _, known := range knownErrors {
+		if msg == known.Error() {
+			return known
+		}
+		if strings.HasPrefix(msg, known.Error() + ": ") {
+			return &remote{known, msg}
+		}
+	}
+	return err
+}
+
+type remote struct {
+	err error
+	msg string
+}
+
+func (this *remote) Error() string {
+	return this.msg
+}
+
+func (this *remote) Unwrap() error {
+	return this.err
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, TimeOutError) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// callError classifies the failure of a call on the owner of a key.
+func callError(err error) error {
+	err = remoteError(err)
+	switch {
+	case errors.Is(err, DeleteNonExistenceError):
+		return NotFoundError
+	case errors.Is(err, context.DeadlineExceeded):
+		return TimeOutError
+	case errors.Is(err, UnreachableError), errors.Is(err, InvalidAddressError):
+		return NoRouteError
+	}
+	return err
+}
+
+// lookupError classifies the failure of a lookup: anything but a timeout or a
+// cancellation means that no route to the owner was found.
+func lookupError(err error) error {
+	err = remoteError(err)
+	switch {
+	case isTimeout(err):
+		return TimeOutError
+	case errors.Is(err, context.Canceled):
+		return err
+	}
+	return &remote{NoRouteError, NoRouteError.Error() + ": " + err.Error()}
+}
@@ -0,0 +1,264 @@
+package dht
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+const defaultPhiThreshold float64 = 8
+const defaultPhiWindow int = 100
+
+// FailureDetector is a phi-accrual failure detector. It keeps the intervals
+// between the heartbeats of each peer and tells, as phi, how unlikely it is
+// that the next one is merely late: phi 1 means a 10% chance, phi 2 a 1% chance,
+// and so on. A peer is suspected once its phi exceeds Threshold, so that a
+// single slow answer does not take it for dead.
+type FailureDetector struct {
+	Threshold float64
+	Window int               // intervals kept per peer
+	MinStdDev time.Duration  // floor of the deviation, as heartbeats are regular; half the period unless set
+
+	clock Clock
+	expected time.Duration
+	peers map[string] *heartbeats
+	pending map[string] bool
+	lock sync.Mutex
+}
+
+type heartbeats struct {
+	last time.Time
+	intervals []time.Duration
+	down bool
+}
+
+// NewFailureDetector returns a detector of peers sending a heartbeat every
+// period.
+func NewFailureDetector(clock Clock, period time.Duration) *FailureDetector {
+	return &FailureDetector{
+		Threshold : defaultPhiThreshold,
+		Window : defaultPhiWindow,
+		MinStdDev : period / 2,
+		clock : clock,
+		expected : period,
+		peers : make(map[string] *heartbeats),
+		pending : make(map[string] bool),
+	}
+}
+
+// SetPeriod sets the interval between heartbeats, and MinStdDev along with it,
+// so that a failure is detected after as many periods whatever their length.
+func (this *FailureDetector) SetPeriod(period time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.expected = period
+	this.MinStdDev = period / 2
+}
+
+// Heartbeat records that addr has just been heard from.
+func (this *FailureDetector) Heartbeat(addr string) {
+	now := this.clock.Now()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	peer, ok := this.peers[addr]
+	if !ok || peer.last.IsZero() {
+		// Start from the expected interval, so that one heartbeat is enough.
+		// A peer found down before it was ever heard from starts the same.
+		this.peers[addr] = &heartbeats{last: now, intervals: []time.Duration{this.expected}}
+		return
+	}
+	// The time a peer was down is no interval between its heartbeats.
+	if !peer.down {
+		peer.intervals = append(peer.intervals, now.Sub(peer.last))
+		if len(peer.intervals) > this.Window {
+			peer.intervals = peer.intervals[len(peer.intervals) - this.Window :]
+		}
+	}
+	peer.last, peer.down = now, false
+}
+
+// Down records that addr refused a heartbeat, which no delay explains. It is
+// suspected until its next heartbeat.
+func (this *FailureDetector) Down(addr string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if peer, ok := this.peers[addr] ; ok {
+		peer.down = true
+	} else {
+		this.peers[addr] = &heartbeats{down: true}
+	}
+}
+
+// Phi returns the suspicion level of addr, 0 for a peer never heard of and
+// +Inf for one that is down.
+func (this *FailureDetector) Phi(addr string) float64 {
+	now := this.clock.Now()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	peer, ok := this.peers[addr]
+	if !ok {
+		return 0
+	}
+	if peer.down {
+		return math.Inf(1)
+	}
+	return phi(now.Sub(peer.last), peer.intervals, this.MinStdDev)
+}
+
+// phi approximates -log10 of the chance that a heartbeat comes later than
+// elapsed, the intervals being taken as normally distributed.
+func phi(elapsed time.Duration, intervals []time.Duration, minStdDev time.Duration) float64 {
+	var sum, squares float64
+	for _, interval := range intervals {
+		sum += float64(interval)
+		squares += float64(interval) * float64(interval)
+	}
+	n := float64(len(intervals))
+	mean := sum / n
+	stdDev := math.Sqrt(math.Max(squares / n - mean * mean, 0))
+	if stdDev < float64(minStdDev) {
+		stdDev = float64(minStdDev)
+	}
+	y := (float64(elapsed) - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566 * y * y))
+	if float64(elapsed) > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1 / (1 + e))
+}
+
+// expect marks a heartbeat of addr as requested, unless one still is.
+func (this *FailureDetector) expect(addr string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.pending[addr] {
+		return false
+	}
+	this.pending[addr] = true
+	return true
+}
+
+func (this *FailureDetector) answered(addr string) {
+	this.lock.Lock()
+	delete(this.pending, addr)
+	this.lock.Unlock()
+}
+
+// Known tells whether addr has been heard of.
+func (this *FailureDetector) Known(addr string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, ok := this.peers[addr]
+	return ok
+}
+
+// Suspected tells whether the phi of addr exceeds the threshold.
+func (this *FailureDetector) Suspected(addr string) bool {
+	return this.Phi(addr) > this.Threshold
+}
+
+// Levels returns the phi of every peer followed.
+func (this *FailureDetector) Levels() map[string] float64 {
+	this.lock.Lock()
+	addrs := make([]string, 0, len(this.peers))
+	for addr := range this.peers {
+		addrs = append(addrs, addr)
+	}
+	this.lock.Unlock()
+	levels := make(map[string] float64, len(addrs))
+	for _, addr := range addrs {
+		levels[addr] = this.Phi(addr)
+	}
+	return levels
+}
+
+// Retain forgets every peer but those in addrs, so that a node coming back
+// later is not judged by its old heartbeats.
+func (this *FailureDetector) Retain(addrs []string) {
+	keep := make(map[string] bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for addr := range this.peers {
+		if !keep[addr] {
+			delete(this.peers, addr)
+		}
+	}
+}
+
+// monitored returns the predecessors, successors and fingers of the node, once
+// each.
+func (this *ChordNode) monitored() []string {
+	seen := map[string] bool{"": true, this.address: true}
+	var peers []string
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			peers = append(peers, addr)
+		}
+	}
+	this.predLock.RLock()
+	for _, addr := range this.predecessor {
+		add(addr)
+	}
+	this.predLock.RUnlock()
+	this.succLock.RLock()
+	for _, addr := range this.successor {
+		add(addr)
+	}
+	this.succLock.RUnlock()
+	for _, addr := range this.finger {
+		add(addr)
+	}
+	return peers
+}
+
+// SendHeartbeats pings the peers the node relies on, and records the answers
+// with the failure detector. A peer which does not answer in time only grows
+// more suspected, while one which cannot be reached at all is down at once.
+// The pings are not waited for, lest a slow peer delay the heartbeats of the
+// others and get them suspected as well.
+func (this *ChordNode) SendHeartbeats() {
+	peers := this.monitored()
+	for _, addr := range peers {
+		addr := addr
+		if !this.detector.expect(addr) {
+			continue
+		}
+		this.clock.Go(func() {
+			defer this.detector.answered(addr)
+			var alive bool
+			err := this.transport.Call(context.Background(), addr, "RPCWrapper.Ping", 0, &alive)
+			switch {
+			case err == nil && alive:
+				this.detector.Heartbeat(addr)
+				this.remember(addr)
+			case err == nil, !isTimeout(err):
+				if !this.detector.Suspected(addr) {
+					log.Warningf("Node %s finds %s down: %v.\n", this.address, addr, err)
+				}
+				this.detector.Down(addr)
+			}
+		})
+	}
+	this.detector.Retain(peers)
+}
+
+// alive tells whether addr is taken for alive. Peers the failure detector has
+// not heard of yet are pinged.
+func (this *ChordNode) alive(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	if addr == this.address {
+		return this.listening
+	}
+	if this.detector.Known(addr) {
+		return !this.detector.Suspected(addr)
+	}
+	return this.transport.Ping(addr)
+}
@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+// stepClock is a clock which only moves when told to.
+type stepClock struct {
+	now time.Time
+}
+
+func (this *stepClock) Now() time.Time {
+	return this.now
+}
+
+func (this *stepClock) Sleep(d time.Duration) {
+	this.now = this.now.Add(d)
+}
+
+func (this *stepClock) Go(f func()) {
+	go f()
+}
+
+func (this *stepClock) Wait(done <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <- done:
+		return true
+	default:
+		this.Sleep(timeout)
+		return false
+	}
+}
+
+func TestPhi(t *testing.T) {
+	second := time.Second
+	tests := []struct {
+		name string
+		elapsed time.Duration
+		intervals []time.Duration
+		minStdDev time.Duration
+		min, max float64
+	}{
+		{name : "on time", elapsed : second, intervals : []time.Duration{second, second}, minStdDev : second / 2, min : 0.29, max : 0.31},
+		{name : "early", elapsed : 0, intervals : []time.Duration{second, second}, minStdDev : second / 2, min : 0, max : 0.05},
+		{name : "five deviations late", elapsed : 3500 * time.Millisecond, intervals : []time.Duration{second, second}, minStdDev : second / 2, min : 7, max : 7.6},
+		{name : "deviation of the intervals", elapsed : 3500 * time.Millisecond, intervals : []time.Duration{second / 2, 3 * second / 2}, minStdDev : second / 10, min : 7, max : 7.6},
+		{name : "deviation floored", elapsed : 3500 * time.Millisecond, intervals : []time.Duration{second / 2, 3 * second / 2}, minStdDev : second, min : 2, max : 2.4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := phi(test.elapsed, test.intervals, test.minStdDev) ; got < test.min || got > test.max {
+				t.Errorf("phi = %.3f, want within [%g, %g]", got, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestFailureDetectorPeriod(t *testing.T) {
+	tests := []struct {
+		name string
+		period time.Duration
+	}{
+		{name : "maintain period", period : maintainPeriod},
+		{name : "short period", period : 10 * time.Millisecond},
+		{name : "long period", period : 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &stepClock{now: time.Unix(0, 0)}
+			detector := NewFailureDetector(clock, maintainPeriod)
+			detector.SetPeriod(test.period)
+			for i := 0 ; i < 10 ; i ++ {
+				detector.Heartbeat("peer")
+				clock.Sleep(test.period)
+			}
+			// Regular heartbeats leave only the floor of half a period as their
+			// deviation, which phi 8 takes about 5 of to exceed.
+			if periods := silentPeriods(detector, clock, test.period) ; periods != 4 {
+				t.Errorf("suspected after %d silent periods, want 4", periods)
+			}
+		})
+	}
+}
+
+// silentPeriods returns the number of periods after which the peer, silent
+// for one, is suspected.
+func silentPeriods(detector *FailureDetector, clock *stepClock, period time.Duration) int {
+	periods := 1
+	for ; !detector.Suspected("peer") && periods < 100 ; periods ++ {
+		clock.Sleep(period)
+	}
+	return periods
+}
+
+func TestFailureDetectorRecovery(t *testing.T) {
+	period := maintainPeriod
+	heard := func(detector *FailureDetector, clock *stepClock) {
+		for i := 0 ; i < 10 ; i ++ {
+			detector.Heartbeat("peer")
+			clock.Sleep(period)
+		}
+	}
+	tests := []struct {
+		name string
+		before func(detector *FailureDetector, clock *stepClock)
+	}{
+		{name : "never down", before : heard},
+		{
+			name : "down before any heartbeat",
+			before : func(detector *FailureDetector, clock *stepClock) {
+				detector.Down("peer")
+			},
+		},
+		{
+			name : "down for an hour before any heartbeat",
+			before : func(detector *FailureDetector, clock *stepClock) {
+				detector.Down("peer")
+				clock.Sleep(time.Hour)
+			},
+		},
+		{
+			name : "down for a minute",
+			before : func(detector *FailureDetector, clock *stepClock) {
+				heard(detector, clock)
+				detector.Down("peer")
+				clock.Sleep(time.Minute)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &stepClock{now: time.Unix(0, 0)}
+			detector := NewFailureDetector(clock, period)
+			test.before(detector, clock)
+			detector.Heartbeat("peer")
+			if detector.Suspected("peer") {
+				t.Fatal("suspected right after a heartbeat")
+			}
+			clock.Sleep(period)
+			if periods := silentPeriods(detector, clock, period) ; periods != 4 {
+				t.Errorf("suspected after %d silent periods, want 4", periods)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Faults describes how calls misbehave on their way through a FaultInjector.
+type Faults struct {
+	Latency, Jitter time.Duration
+	DropRate float64      // probability that a call is lost before delivery
+	ReplyDropRate float64 // probability that the reply of a delivered call is lost
+	DuplicateRate float64 // probability that a call is delivered twice
+}
+
+// FaultInjector wraps a transport and degrades the calls going through it. Its
+// settings may be changed at any time while the ring runs.
+type FaultInjector struct {
+	Timeout time.Duration
+
+	inner Transport
+	clock Clock
+	rand *rand.Rand
+	faults Faults
+	nodeFaults map[string] Faults
+	group map[string] int
+	lock sync.Mutex
+}
+
+func NewFaultInjector(inner Transport, clock Clock, seed int64) *FaultInjector {
+	return &FaultInjector{
+		Timeout : maintainPeriod * 3,
+		inner : inner,
+		clock : clock,
+		rand : rand.New(rand.NewSource(seed)),
+		nodeFaults : make(map[string] Faults),
+		group : make(map[string] int),
+	}
+}
+
+// Transport returns the view of the injector used by the node at address.
+func (this *FaultInjector) Transport(address string) Transport {
+	return &faultyTransport{injector: this, from: address}
+}
+
+func (this *FaultInjector) Set(faults Faults) {
+	this.lock.Lock()
+	this.faults = faults
+	this.lock.Unlock()
+}
+
+// SetNode overrides the faults of every call from or to address.
+func (this *FaultInjector) SetNode(address string, faults Faults) {
+	this.lock.Lock()
+	this.nodeFaults[address] = faults
+	this.lock.Unlock()
+}
+
+func (this *FaultInjector) ClearNode(address string) {
+	this.lock.Lock()
+	delete(this.nodeFaults, address)
+	this.lock.Unlock()
+}
+
+// Partition splits the listed addresses into groups which cannot reach each
+// other. Addresses outside every group still reach everyone.
+func (this *FaultInjector) Partition(groups ...[]string) {
+	this.lock.Lock()
+	this.group = make(map[string] int)
+	for i, group := range groups {
+		for _, address := range group {
+			this.group[address] = i
+		}
+	}
+	this.lock.Unlock()
+}
+
+func (this *FaultInjector) Heal() {
+	this.Partition()
+}
+
+type faultPlan struct {
+	blocked, drop, dropReply, duplicate bool
+	delay time.Duration
+}
+
+// plan draws the faults of a call. The virtual nodes of a node share its
+// faults and its side of a partition.
+func (this *FaultInjector) plan(from, to string) faultPlan {
+	from, _ = splitAddress(from)
+	to, _ = splitAddress(to)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var plan faultPlan
+	gFrom, okFrom := this.group[from]
+	gTo, okTo := this.group[to]
+	plan.blocked = okFrom && okTo && gFrom != gTo
+	faults := this.faults
+	if f, ok := this.nodeFaults[to] ; ok {
+		faults = f
+	} else if f, ok := this.nodeFaults[from] ; ok {
+		faults = f
+	}
+	plan.delay = faults.Latency
+	if faults.Jitter > 0 {
+		plan.delay += time.Duration(this.rand.Int63n(int64(faults.Jitter)))
+	}
+	plan.drop = this.rand.Float64() < faults.DropRate
+	plan.dropReply = this.rand.Float64() < faults.ReplyDropRate
+	plan.duplicate = this.rand.Float64() < faults.DuplicateRate
+	return plan
+}
+
+type faultyTransport struct {
+	injector *FaultInjector
+	from string
+}
+
+func (this *faultyTransport) Serve(address string, service interface{}) (io.Closer, error) {
+	return this.injector.inner.Serve(address, service)
+}
+
+func (this *faultyTransport) Call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	injector := this.injector
+	plan := injector.plan(this.from, address)
+	if plan.delay > 0 {
+		injector.clock.Sleep(plan.delay)
+	}
+	if plan.blocked || plan.drop {
+		return injector.lose(ctx)
+	}
+	if plan.duplicate {
+		injector.clock.Go(func() {
+			var duplicate interface{}
+			if reply != nil {
+				duplicate = reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+			}
+			_ = injector.inner.Call(context.Background(), address, method, args, duplicate)
+		})
+	}
+	err := injector.inner.Call(ctx, address, method, args, reply)
+	if plan.dropReply {
+		return injector.lose(ctx)
+	}
+	return err
+}
+
+// lose waits out a call which gets no answer, until the deadline of ctx or, if
+// it has none, for Timeout.
+func (this *FaultInjector) lose(ctx context.Context) error {
+	timeout := this.Timeout
+	if deadline, ok := ctx.Deadline() ; ok {
+		timeout = time.Until(deadline)
+	}
+	if this.clock.Wait(ctx.Done(), timeout) {
+		return ctx.Err()
+	}
+	return TimeOutError
+}
+
+func (this *faultyTransport) Ping(address string) bool {
+	plan := this.injector.plan(this.from, address)
+	if plan.delay > 0 {
+		this.injector.clock.Sleep(plan.delay)
+	}
+	if plan.blocked || plan.drop {
+		return false
+	}
+	return this.injector.inner.Ping(address)
+}
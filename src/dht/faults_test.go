@@ -0,0 +1,185 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// CountService counts the calls delivered to it.
+type CountService struct {
+	calls *int
+}
+
+func (this *CountService) Count(args int, reply *int) error {
+	*this.calls ++
+	*reply = *this.calls
+	return nil
+}
+
+func TestFaultInjector(t *testing.T) {
+	const from, to = "10.0.0.1:1", "10.0.0.2:1"
+	timeout := time.Second
+	tests := []struct {
+		name string
+		to string // the address called, to unless set
+		setup func(injector *FaultInjector)
+		fails bool
+		delivered int
+		elapsed time.Duration
+		ping bool
+	}{
+		{
+			name : "no faults",
+			delivered : 1,
+			ping : true,
+		},
+		{
+			name : "latency",
+			setup : func(injector *FaultInjector) {
+				injector.Set(Faults{Latency : 100 * time.Millisecond})
+			},
+			delivered : 1,
+			elapsed : 100 * time.Millisecond,
+			ping : true,
+		},
+		{
+			name : "drop",
+			setup : func(injector *FaultInjector) {
+				injector.Set(Faults{DropRate : 1})
+			},
+			fails : true,
+			elapsed : timeout,
+		},
+		{
+			name : "reply dropped",
+			setup : func(injector *FaultInjector) {
+				injector.Set(Faults{ReplyDropRate : 1})
+			},
+			fails : true,
+			delivered : 1,
+			elapsed : timeout,
+			ping : true,
+		},
+		{
+			name : "duplicate",
+			setup : func(injector *FaultInjector) {
+				injector.Set(Faults{DuplicateRate : 1})
+			},
+			delivered : 2,
+			ping : true,
+		},
+		{
+			name : "faults of the callee",
+			setup : func(injector *FaultInjector) {
+				injector.SetNode(to, Faults{DropRate : 1})
+			},
+			fails : true,
+			elapsed : timeout,
+		},
+		{
+			name : "node overrides the defaults",
+			setup : func(injector *FaultInjector) {
+				injector.Set(Faults{DropRate : 1})
+				injector.SetNode(from, Faults{})
+			},
+			delivered : 1,
+			ping : true,
+		},
+		{
+			name : "node cleared",
+			setup : func(injector *FaultInjector) {
+				injector.SetNode(to, Faults{DropRate : 1})
+				injector.ClearNode(to)
+			},
+			delivered : 1,
+			ping : true,
+		},
+		{
+			name : "partition",
+			setup : func(injector *FaultInjector) {
+				injector.Partition([]string{from}, []string{to})
+			},
+			fails : true,
+			elapsed : timeout,
+		},
+		{
+			name : "virtual node across a partition",
+			to : to + virtualSeparator + "1",
+			setup : func(injector *FaultInjector) {
+				injector.Partition([]string{from}, []string{to})
+			},
+			fails : true,
+			elapsed : timeout,
+		},
+		{
+			name : "same side",
+			setup : func(injector *FaultInjector) {
+				injector.Partition([]string{from, to})
+			},
+			delivered : 1,
+			ping : true,
+		},
+		{
+			name : "outside the partition",
+			setup : func(injector *FaultInjector) {
+				injector.Partition([]string{from})
+			},
+			delivered : 1,
+			ping : true,
+		},
+		{
+			name : "healed",
+			setup : func(injector *FaultInjector) {
+				injector.Partition([]string{from}, []string{to})
+				injector.Heal()
+			},
+			delivered : 1,
+			ping : true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := NewSimulator(1)
+			sim.MinLatency, sim.MaxLatency = 0, 0
+			address := to
+			if test.to != "" {
+				address = test.to
+			}
+			var calls int
+			if _, err := sim.Serve(address, &CountService{&calls}) ; err != nil {
+				t.Fatal(err)
+			}
+			injector := NewFaultInjector(sim, sim, 1)
+			injector.Timeout = timeout
+			if test.setup != nil {
+				test.setup(injector)
+			}
+			transport := injector.Transport(from)
+			var err error
+			var elapsed time.Duration
+			var ping bool
+			sim.Run(func() {
+				start := sim.Now()
+				var reply int
+				err = transport.Call(context.Background(), address, "CountService.Count", 0, &reply)
+				elapsed = sim.Now().Sub(start)
+				// Let a duplicate arrive.
+				sim.Sleep(time.Millisecond)
+				ping = transport.Ping(address)
+			})
+			if (err != nil) != test.fails {
+				t.Errorf("got error %v, want failure %v", err, test.fails)
+			}
+			if calls != test.delivered {
+				t.Errorf("delivered %d times, want %d", calls, test.delivered)
+			}
+			if elapsed != test.elapsed {
+				t.Errorf("took %v, want %v", elapsed, test.elapsed)
+			}
+			if ping != test.ping {
+				t.Errorf("ping got %v, want %v", ping, test.ping)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package dht
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultSnapshotEvery int = 1024
+
+const fileStoreLogName string = "wal.log"
+const fileStoreSnapshotName string = "snapshot.json"
+
+// FileStore is a Store made durable in a directory: every change is appended
+// to a write-ahead log and synced before it is applied in memory, and the log
+// is folded into a snapshot every SnapshotEvery records. Reads are served from
+// memory.
+type FileStore struct {
+	MemStore
+	SnapshotEvery int
+
+	dir string
+	file *os.File
+	records int
+	lock sync.Mutex
+}
+
+type fileStoreRecord struct {
+	Op string `json:"op"`
+	Key string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	Keys []string `json:"keys,omitempty"`
+	Entries map[string] string `json:"entries,omitempty"`
+}
+
+// OpenFileStore recovers the content kept in dir, creating the directory if
+// needed, and opens the log for appending.
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755) ; err != nil {
+		return nil, err
+	}
+	this := &FileStore{
+		MemStore : MemStore{entries : make(map[string] string)},
+		SnapshotEvery : defaultSnapshotEvery,
+		dir : dir,
+	}
+	if err := this.loadSnapshot() ; err != nil {
+		return nil, err
+	}
+	intact, err := this.replay()
+	if err != nil {
+		return nil, err
+	}
+	// Cut a torn record off, or the records appended after it would be lost
+	// with it on the next replay.
+	path := filepath.Join(dir, fileStoreLogName)
+	if err = os.Truncate(path, intact) ; err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	this.file = file
+	return this, nil
+}
+
+func (this *FileStore) loadSnapshot() error {
+	content, err := os.ReadFile(filepath.Join(this.dir, fileStoreSnapshotName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, &this.entries) ; err != nil {
+		return err
+	}
+	if this.entries == nil {
+		this.entries = make(map[string] string)
+	}
+	return nil
+}
+
+// replay applies the log on top of the snapshot, and returns the length of the
+// records it applied. A torn record at the end of the log, left by a crash in
+// the middle of a write, ends the replay.
+func (this *FileStore) replay() (int64, error) {
+	file, err := os.Open(filepath.Join(this.dir, fileStoreLogName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var intact int64
+	for {
+		// A record is only whole with its newline.
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		var record fileStoreRecord
+		if json.Unmarshal(line, &record) != nil {
+			break
+		}
+		this.apply(record)
+		this.records ++
+		intact += int64(len(line))
+	}
+	return intact, nil
+}
+
+func (this *FileStore) apply(record fileStoreRecord) {
+	switch record.Op {
+	case "put" :
+		this.MemStore.Put(record.Key, record.Value)
+	case "delete" :
+		this.MemStore.Delete(record.Key)
+	case "put-all" :
+		this.MemStore.PutAll(record.Entries)
+	case "delete-all" :
+		this.MemStore.DeleteAll(record.Keys)
+	case "clear" :
+		this.MemStore.Clear()
+	}
+}
+
+func (this *FileStore) append(record fileStoreRecord) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = this.file.Write(append(line, '\n')) ; err != nil {
+		return err
+	}
+	if err = this.file.Sync() ; err != nil {
+		return err
+	}
+	this.apply(record)
+	this.records ++
+	if this.SnapshotEvery > 0 && this.records >= this.SnapshotEvery {
+		return this.snapshot()
+	}
+	return nil
+}
+
+func (this *FileStore) Put(key string, value string) error {
+	return this.append(fileStoreRecord{Op: "put", Key: key, Value: value})
+}
+
+func (this *FileStore) Delete(key string) error {
+	return this.append(fileStoreRecord{Op: "delete", Key: key})
+}
+
+func (this *FileStore) PutAll(entries map[string] string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return this.append(fileStoreRecord{Op: "put-all", Entries: entries})
+}
+
+func (this *FileStore) DeleteAll(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return this.append(fileStoreRecord{Op: "delete-all", Keys: keys})
+}
+
+func (this *FileStore) Clear() error {
+	return this.append(fileStoreRecord{Op: "clear"})
+}
+
+func (this *FileStore) Snapshot() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.snapshot()
+}
+
+// snapshot writes the content next to the old snapshot, renames it into place
+// and only then truncates the log. Each step reaches the disk before the next,
+// so that a crash leaves either snapshot with a log that completes it. The
+// caller must hold lock.
+func (this *FileStore) snapshot() error {
+	this.MemStore.lock.RLock()
+	content, err := json.Marshal(this.entries)
+	this.MemStore.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(this.dir, fileStoreSnapshotName + ".tmp")
+	if err = writeFileSync(tmp, content) ; err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(this.dir, fileStoreSnapshotName)) ; err != nil {
+		return err
+	}
+	if err = syncDir(this.dir) ; err != nil {
+		return err
+	}
+	if err = this.file.Truncate(0) ; err != nil {
+		return err
+	}
+	if err = this.file.Sync() ; err != nil {
+		return err
+	}
+	this.records = 0
+	return nil
+}
+
+func writeFileSync(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content) ; err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync() ; err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes the renames in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (this *FileStore) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.file.Close()
+}
@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStoreRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		snapshotEvery int
+		writes func(store *FileStore) error
+		torn string
+		after func(store *FileStore) error // writes made once recovered
+		want map[string] string
+	}{
+		{
+			name : "log only",
+			writes : func(store *FileStore) error {
+				store.Put("a", "1")
+				store.Put("b", "2")
+				store.Delete("a")
+				return store.PutAll(map[string] string{"c": "3", "d": "4"})
+			},
+			want : map[string] string{"b": "2", "c": "3", "d": "4"},
+		},
+		{
+			name : "clear and delete-all",
+			writes : func(store *FileStore) error {
+				store.PutAll(map[string] string{"a": "1", "b": "2"})
+				store.Clear()
+				store.PutAll(map[string] string{"c": "3", "d": "4", "e": "5"})
+				return store.DeleteAll([]string{"c", "e"})
+			},
+			want : map[string] string{"d": "4"},
+		},
+		{
+			name : "torn record",
+			writes : func(store *FileStore) error {
+				return store.Put("a", "1")
+			},
+			torn : `{"op":"put","key":"b","val`,
+			want : map[string] string{"a": "1"},
+		},
+		{
+			name : "write after a torn record",
+			writes : func(store *FileStore) error {
+				return store.Put("a", "1")
+			},
+			torn : `{"op":"put","key":"b","val`,
+			after : func(store *FileStore) error {
+				return store.Put("c", "3")
+			},
+			want : map[string] string{"a": "1", "c": "3"},
+		},
+		{
+			name : "record without its newline",
+			writes : func(store *FileStore) error {
+				return store.Put("a", "1")
+			},
+			torn : `{"op":"put","key":"b","value":"2"}`,
+			after : func(store *FileStore) error {
+				return store.Put("c", "3")
+			},
+			want : map[string] string{"a": "1", "c": "3"},
+		},
+		{
+			name : "snapshot and log",
+			snapshotEvery : 2,
+			writes : func(store *FileStore) error {
+				store.Put("a", "1")
+				store.Put("b", "2")
+				store.Put("c", "3")
+				return store.Delete("b")
+			},
+			want : map[string] string{"a": "1", "c": "3"},
+		},
+		{
+			name : "snapshot with empty log",
+			writes : func(store *FileStore) error {
+				store.Put("a", "1")
+				store.Put("b", "2")
+				return store.Snapshot()
+			},
+			want : map[string] string{"a": "1", "b": "2"},
+		},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		store, err := OpenFileStore(dir)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if test.snapshotEvery > 0 {
+			store.SnapshotEvery = test.snapshotEvery
+		}
+		if err = test.writes(store) ; err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err = store.Close() ; err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if test.torn != "" {
+			file, err := os.OpenFile(filepath.Join(dir, fileStoreLogName), os.O_WRONLY | os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			file.WriteString(test.torn)
+			file.Close()
+		}
+		recovered, err := OpenFileStore(dir)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if test.after != nil {
+			if err = test.after(recovered) ; err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			recovered.Close()
+			if recovered, err = OpenFileStore(dir) ; err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		if got := entriesOf(recovered) ; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: recovered %v, want %v", test.name, got, test.want)
+		}
+		recovered.Close()
+	}
+}
+
+func TestFileStoreSnapshotTruncatesLog(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.SnapshotEvery = 3
+	for _, key := range []string{"a", "b", "c"} {
+		if err = store.Put(key, key) ; err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, fileStoreLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("log holds %d bytes after the snapshot, want 0", info.Size())
+	}
+	if _, err = os.Stat(filepath.Join(dir, fileStoreSnapshotName + ".tmp")) ; !os.IsNotExist(err) {
+		t.Errorf("temporary snapshot left behind: %v", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/sha1"
 	"math/big"
 	"net"
+	"strconv"
+	"strings"
 )
 
 func hashString(elt string) *big.Int {
@@ -25,6 +27,27 @@ func jump(address string, fingerentry int) *big.Int {
 	return new(big.Int).Mod(sum, hashMod)
 }
 
+// The virtual nodes of a node beyond the first are addressed by the address of
+// the node followed by their index, e.g. "10.0.0.1:8000#2", so that each one
+// hashes to a position of its own.
+const virtualSeparator string = "#"
+
+func virtualAddress(address string, i int) string {
+	if i == 0 {
+		return address
+	}
+	return address + virtualSeparator + strconv.Itoa(i)
+}
+
+// splitAddress returns the network address of a node and the suffix naming the
+// virtual node, empty for the first one.
+func splitAddress(address string) (string, string) {
+	if i := strings.Index(address, virtualSeparator) ; i >= 0 {
+		return address[: i], address[i :]
+	}
+	return address, ""
+}
+
 func between(start, elt, end *big.Int, inclusive bool) bool {
 	if end.Cmp(start) > 0 {
 		return (start.Cmp(elt) < 0 && elt.Cmp(end) < 0) || (inclusive && elt.Cmp(end) == 0)
@@ -0,0 +1,660 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Kademlia node keeps up to kademliaK contacts per k-bucket and sends
+// kademliaAlpha requests at once during a lookup.
+const kademliaK int = 20
+const kademliaAlpha int = 3
+
+// Buckets are refreshed every kademliaRefreshRounds maintenance periods, and
+// keys republished every kademliaRepublishRounds.
+const kademliaRefreshRounds int = 8
+const kademliaRepublishRounds int = 40
+
+// FindArgs asks for the contacts closest to ID, or for Key, which hashes to ID,
+// by the node at From.
+type FindArgs struct {
+	From string
+	ID *big.Int
+	Key string
+}
+
+type FindValueReply struct {
+	Found bool
+	Entry StampedEntry
+	Contacts []string
+}
+
+// StoreArgs carries encoded entries from the node at From.
+type StoreArgs struct {
+	From string
+	Entries map[string] string
+}
+
+// KademliaNode is a node of a Kademlia network: it keeps contacts by XOR
+// distance in k-buckets, and the keys on the nodes closest to them.
+type KademliaNode struct {
+	stampedBase
+	// stored keeps when each key was last stored by another node, which then
+	// republishes it in place of this one.
+	stored map[string] time.Time
+	storedLock sync.Mutex
+
+	table [keySize] []string
+	// arrived are the contacts added to the table since the last handover.
+	arrived []string
+	tableLock sync.Mutex
+	refresh int
+}
+
+func NewKademliaNode(port int, transport Transport) *KademliaNode {
+	address := GetLocalAddress() + ":" + strconv.Itoa(port)
+	return &KademliaNode {
+		stampedBase : stampedBase{
+			address : address,
+			id : hashString(address),
+			transport : transport,
+			clock : DefaultClock,
+			period : maintainPeriod,
+			data : NewMemStore(),
+			replicas : kademliaK,
+			tombstoneGrace : defaultTombstoneGrace,
+		},
+		stored : make(map[string] time.Time),
+		refresh : keySize - 1,
+	}
+}
+
+// SetReplicas sets the number of nodes storing each key, at most kademliaK.
+func (this *KademliaNode) SetReplicas(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n > kademliaK {
+		n = kademliaK
+	}
+	this.replicas = n
+}
+
+func distance(a, b *big.Int) *big.Int {
+	return new(big.Int).Xor(a, b)
+}
+
+// bucketIndex returns the k-bucket of id: the contacts in bucket i are at a
+// distance in [2^i, 2^(i+1)).
+func (this *KademliaNode) bucketIndex(id *big.Int) int {
+	return distance(this.id, id).BitLen() - 1
+}
+
+// sortByDistance sorts the addresses by their distance to id, the closest
+// first.
+func sortByDistance(addrs []string, id *big.Int) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return distance(hashString(addrs[i]), id).Cmp(distance(hashString(addrs[j]), id)) < 0
+	})
+}
+
+func without(addrs []string, addr string) []string {
+	result := make([]string, 0, len(addrs))
+	for _, elt := range addrs {
+		if elt != addr {
+			result = append(result, elt)
+		}
+	}
+	return result
+}
+
+// Closest returns the n contacts closest to id.
+func (this *KademliaNode) Closest(id *big.Int, n int) []string {
+	var contacts []string
+	this.tableLock.Lock()
+	for _, bucket := range this.table {
+		contacts = append(contacts, bucket...)
+	}
+	this.tableLock.Unlock()
+	sortByDistance(contacts, id)
+	if len(contacts) > n {
+		contacts = contacts[: n]
+	}
+	return contacts
+}
+
+// touch records that contact was heard from. It moves to the tail of its
+// bucket; a new contact takes the place of the least recently seen one if that
+// one no longer answers.
+func (this *KademliaNode) touch(contact string) {
+	if contact == "" || contact == this.address {
+		return
+	}
+	i := this.bucketIndex(hashString(contact))
+	this.tableLock.Lock()
+	bucket := this.table[i]
+	for _, known := range bucket {
+		if known == contact {
+			this.table[i] = append(without(bucket, contact), contact)
+			this.tableLock.Unlock()
+			return
+		}
+	}
+	if len(bucket) < kademliaK {
+		this.table[i] = append(bucket, contact)
+		this.arrive(contact)
+		this.tableLock.Unlock()
+		return
+	}
+	oldest := bucket[0]
+	this.tableLock.Unlock()
+	this.clock.Go(func() {
+		alive := this.transport.Ping(oldest)
+		this.tableLock.Lock()
+		bucket := without(this.table[i], oldest)
+		if alive {
+			this.table[i] = append(bucket, oldest)
+			this.tableLock.Unlock()
+			return
+		}
+		this.table[i] = append(bucket, contact)
+		this.arrive(contact)
+		this.tableLock.Unlock()
+	})
+}
+
+// arrive queues a new contact for the next handover. The caller must hold
+// tableLock.
+func (this *KademliaNode) arrive(contact string) {
+	if !contains(this.arrived, contact) {
+		this.arrived = append(this.arrived, contact)
+	}
+}
+
+// drop forgets a contact which failed to answer.
+func (this *KademliaNode) drop(contact string) {
+	i := this.bucketIndex(hashString(contact))
+	if i < 0 {
+		return
+	}
+	this.tableLock.Lock()
+	this.table[i] = without(this.table[i], contact)
+	this.tableLock.Unlock()
+}
+
+func (this *KademliaNode) call(ctx context.Context, addr string, method string, args interface{}, reply interface{}) error {
+	err := this.transport.Call(ctx, addr, "KademliaWrapper." + method, args, reply)
+	if err != nil && ctx.Err() == nil {
+		log.Warningf("Node %s drops contact %s: %s.\n", this.address, addr, err)
+		this.drop(addr)
+	}
+	return err
+}
+
+func (this *KademliaNode) readEntry(key string) (StampedEntry, bool) {
+	content, ok := this.data.Get(key)
+	if !ok {
+		return StampedEntry{}, false
+	}
+	return decodeEntry(content), true
+}
+
+func (this *KademliaNode) FindNode(args FindArgs, contacts *[]string) error {
+	this.touch(args.From)
+	*contacts = without(this.Closest(args.ID, kademliaK + 1), args.From)
+	return nil
+}
+
+// FindValue returns the entry of the key if this node holds it, and the
+// contacts closest to it in any case.
+func (this *KademliaNode) FindValue(args FindArgs, reply *FindValueReply) error {
+	this.touch(args.From)
+	reply.Entry, reply.Found = this.readEntry(args.Key)
+	reply.Contacts = without(this.Closest(args.ID, kademliaK + 1), args.From)
+	return nil
+}
+
+// Store merges the entries, keeping the latest write of each key, and counts
+// the keys that held a value before.
+func (this *KademliaNode) Store(args StoreArgs, live *int) error {
+	this.touch(args.From)
+	return this.merge(args.Entries, args.From != "", live)
+}
+
+func (this *KademliaNode) merge(entries map[string] string, remote bool, live *int) error {
+	now := this.clock.Now()
+	this.storedLock.Lock()
+	defer this.storedLock.Unlock()
+	merged := make(map[string] string, len(entries))
+	for key, content := range entries {
+		if remote {
+			this.stored[key] = now
+		}
+		current, ok := this.readEntry(key)
+		if ok && !current.Deleted && live != nil {
+			*live ++
+		}
+		entry := decodeEntry(content)
+		this.stamps.observe(entry.At)
+		if !ok || entry.supersedes(current) {
+			merged[key] = content
+		}
+	}
+	return this.data.PutAll(merged)
+}
+
+// lookup runs the iterative search for the nodes closest to id, asking
+// kademliaAlpha of them at once, and returns the closest ones which answered,
+// this node included. With a key, it also returns the latest entry of the key
+// they hold. It does not stop at the first node holding the key, which may
+// have been left out of a later write.
+func (this *KademliaNode) lookup(ctx context.Context, id *big.Int, key string) ([]string, *StampedEntry, error) {
+	var found *StampedEntry
+	if key != "" {
+		if entry, ok := this.readEntry(key) ; ok {
+			found = &entry
+		}
+	}
+	shortlist := append(this.Closest(id, kademliaK), this.address)
+	sortByDistance(shortlist, id)
+	queried := map[string] bool{this.address: true}
+	answered := map[string] bool{this.address: true}
+	for {
+		if err := ctx.Err() ; err != nil {
+			return nil, nil, err
+		}
+		var round []string
+		for i := 0 ; i < len(shortlist) && i < kademliaK && len(round) < kademliaAlpha ; i ++ {
+			if !queried[shortlist[i]] {
+				round = append(round, shortlist[i])
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+		var lock sync.Mutex
+		var learned []string
+		calls := make([]func(), len(round))
+		for i, addr := range round {
+			addr := addr
+			queried[addr] = true
+			calls[i] = func() {
+				args := FindArgs{From: this.address, ID: id, Key: key}
+				var reply FindValueReply
+				var err error
+				if key == "" {
+					err = this.call(ctx, addr, "FindNode", args, &reply.Contacts)
+				} else {
+					err = this.call(ctx, addr, "FindValue", args, &reply)
+				}
+				if err != nil {
+					return
+				}
+				this.touch(addr)
+				lock.Lock()
+				defer lock.Unlock()
+				answered[addr] = true
+				if reply.Found && (found == nil || reply.Entry.supersedes(*found)) {
+					found = &reply.Entry
+				}
+				learned = append(learned, reply.Contacts...)
+			}
+		}
+		parallel(this.clock, calls)
+		seen := make(map[string] bool)
+		var next []string
+		for _, addr := range append(shortlist, learned...) {
+			if seen[addr] || queried[addr] && !answered[addr] {
+				continue
+			}
+			seen[addr] = true
+			next = append(next, addr)
+		}
+		shortlist = next
+		sortByDistance(shortlist, id)
+	}
+	var closest []string
+	for _, addr := range shortlist {
+		if answered[addr] && len(closest) < kademliaK {
+			closest = append(closest, addr)
+		}
+	}
+	if len(answered) == 1 && len(queried) > 1 {
+		return nil, nil, NoRouteError
+	}
+	return closest, found, nil
+}
+
+// storeOn writes the entries to the given nodes and returns how many took them
+// and how many of the keys they held before.
+func (this *KademliaNode) storeOn(ctx context.Context, addrs []string, entries map[string] string) (int, int) {
+	var lock sync.Mutex
+	acks, live := 0, 0
+	calls := make([]func(), len(addrs))
+	for i, addr := range addrs {
+		addr := addr
+		calls[i] = func() {
+			var held int
+			var err error
+			if addr == this.address {
+				err = this.merge(entries, false, &held)
+			} else {
+				err = this.call(ctx, addr, "Store", StoreArgs{From: this.address, Entries: entries}, &held)
+			}
+			if err != nil {
+				log.Errorln("storeOn: ", err)
+				return
+			}
+			lock.Lock()
+			acks ++
+			live += held
+			lock.Unlock()
+		}
+	}
+	parallel(this.clock, calls)
+	return acks, live
+}
+
+// write stamps the entry of key later than the entry the closest nodes hold,
+// stores it on them, and returns how many of them held a value before.
+func (this *KademliaNode) write(ctx context.Context, key string, entry StampedEntry) (int, error) {
+	closest, found, err := this.lookup(ctx, hashString(key), key)
+	if err != nil {
+		return 0, lookupError(err)
+	}
+	var current int64
+	if found != nil {
+		current = found.At
+	}
+	entry.At = this.stamps.next(this.clock.Now(), current)
+	if len(closest) > this.replicas {
+		closest = closest[: this.replicas]
+	}
+	acks, live := this.storeOn(ctx, closest, map[string] string{key: encodeEntry(entry)})
+	if acks == 0 {
+		return 0, fmt.Errorf("%w: 0 of %d acknowledged", ReplicaWriteError, len(closest))
+	}
+	return live, nil
+}
+
+func (this *KademliaNode) Put(ctx context.Context, key string, value string) error {
+	_, err := this.write(ctx, key, StampedEntry{Value: value})
+	return err
+}
+
+func (this *KademliaNode) Get(ctx context.Context, key string) (string, error) {
+	_, entry, err := this.lookup(ctx, hashString(key), key)
+	if err != nil {
+		return "", lookupError(err)
+	}
+	if entry == nil || entry.Deleted {
+		return "", NotFoundError
+	}
+	return entry.Value, nil
+}
+
+// Delete writes a tombstone over the key, which is kept for the grace period so
+// that no republished copy brings the value back.
+func (this *KademliaNode) Delete(ctx context.Context, key string) error {
+	live, err := this.write(ctx, key, StampedEntry{Deleted: true})
+	if err != nil {
+		return err
+	}
+	if live == 0 {
+		return NotFoundError
+	}
+	return nil
+}
+
+// contactIDs returns the IDs of the known nodes, this one included, for a
+// pass over the store to check every key against without locking the table.
+func (this *KademliaNode) contactIDs() []*big.Int {
+	this.tableLock.Lock()
+	defer this.tableLock.Unlock()
+	ids := []*big.Int{this.id}
+	for _, bucket := range this.table {
+		for _, contact := range bucket {
+			ids = append(ids, hashString(contact))
+		}
+	}
+	return ids
+}
+
+// closerThan reports whether fewer than n of the nodes of ids, see contactIDs,
+// are closer to key than addr.
+func closerThan(ids []*big.Int, addr string, key string, n int) bool {
+	id := hashString(key)
+	limit := distance(hashString(addr), id)
+	closer := 0
+	for _, node := range ids {
+		if distance(node, id).Cmp(limit) < 0 {
+			closer ++
+		}
+	}
+	return closer < n
+}
+
+// handOver sends the contacts which arrived since the last round the keys they
+// are now among the closest nodes of, in one pass over the store.
+func (this *KademliaNode) handOver() {
+	this.tableLock.Lock()
+	arrived := this.arrived
+	this.arrived = nil
+	this.tableLock.Unlock()
+	if len(arrived) == 0 || !this.listening {
+		return
+	}
+	ids := this.contactIDs()
+	batches := make(map[string] map[string] string)
+	for key, content := range entriesOf(this.data) {
+		for _, contact := range arrived {
+			if !closerThan(ids, contact, key, this.replicas) {
+				continue
+			}
+			if batches[contact] == nil {
+				batches[contact] = make(map[string] string)
+			}
+			batches[contact][key] = content
+		}
+	}
+	var calls []func()
+	for contact, entries := range batches {
+		contact, entries := contact, entries
+		calls = append(calls, func() {
+			if err := this.call(context.Background(), contact, "Store", StoreArgs{From: this.address, Entries: entries}, nil) ; err != nil {
+				log.Errorln("handOver: ", err)
+			}
+		})
+	}
+	parallel(this.clock, calls)
+}
+
+// Republish sends the keys to the closest contacts known for each. Keys stored
+// by another node within the last round were republished by it and are left
+// out, unless this node is leaving. Keys this node is no longer among the
+// closest nodes of are dropped once sent, and tombstones past the grace period
+// are dropped instead.
+func (this *KademliaNode) Republish(leaving bool) {
+	now := this.clock.Now()
+	since := now.Add(-this.period * time.Duration(kademliaRepublishRounds))
+	cutoff := now.Add(-this.tombstoneGrace).UnixNano()
+	batches := make(map[string] map[string] string)
+	var expired []string
+	moved := make(map[string] []string)
+	ids := this.contactIDs()
+	// Work on a copy, as merge locks the store under storedLock.
+	for key, content := range entriesOf(this.data) {
+		if entry := decodeEntry(content) ; entry.Deleted && entry.At < cutoff {
+			expired = append(expired, key)
+			continue
+		}
+		this.storedLock.Lock()
+		last, ok := this.stored[key]
+		this.storedLock.Unlock()
+		if !leaving && ok && last.After(since) {
+			continue
+		}
+		closest := this.Closest(hashString(key), this.replicas)
+		if !leaving && !closerThan(ids, this.address, key, this.replicas) {
+			moved[key] = closest
+		}
+		for _, addr := range closest {
+			if batches[addr] == nil {
+				batches[addr] = make(map[string] string)
+			}
+			batches[addr][key] = content
+		}
+	}
+	if err := this.data.DeleteAll(expired) ; err != nil {
+		log.Errorln("Republish: ", err)
+	}
+	addrs := make([]string, 0, len(batches))
+	for addr := range batches {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var lock sync.Mutex
+	sent := make(map[string] bool)
+	calls := make([]func(), len(addrs))
+	for i, addr := range addrs {
+		addr := addr
+		calls[i] = func() {
+			if err := this.call(context.Background(), addr, "Store", StoreArgs{From: this.address, Entries: batches[addr]}, nil) ; err != nil {
+				log.Errorln("Republish: ", err)
+				return
+			}
+			lock.Lock()
+			sent[addr] = true
+			lock.Unlock()
+		}
+	}
+	parallel(this.clock, calls)
+	var handed []string
+	for key, closest := range moved {
+		for _, addr := range closest {
+			if sent[addr] {
+				handed = append(handed, key)
+				break
+			}
+		}
+	}
+	if err := this.data.DeleteAll(handed) ; err != nil {
+		log.Errorln("Republish: ", err)
+	}
+	this.storedLock.Lock()
+	for _, key := range append(expired, handed...) {
+		delete(this.stored, key)
+	}
+	this.storedLock.Unlock()
+	log.Tracef("Node %s republishes to %d contacts and hands %d keys over.\n", this.address, len(addrs), len(handed))
+}
+
+// Refresh looks up the node itself, keeping its closest contacts current, and
+// an ID in each bucket in turn, from the farthest to the closest one in use.
+func (this *KademliaNode) Refresh() {
+	if _, _, err := this.lookup(context.Background(), this.id, "") ; err != nil {
+		log.Errorln("Refresh: ", err)
+	}
+	lowest := keySize
+	this.tableLock.Lock()
+	for i, bucket := range this.table {
+		if len(bucket) > 0 {
+			lowest = i
+			break
+		}
+	}
+	this.tableLock.Unlock()
+	if this.refresh < lowest {
+		this.refresh = keySize - 1
+	}
+	target := new(big.Int).SetBit(new(big.Int).Set(this.id), this.refresh, this.id.Bit(this.refresh) ^ 1)
+	this.refresh --
+	if _, _, err := this.lookup(context.Background(), target, "") ; err != nil {
+		log.Errorln("Refresh: ", err)
+	}
+}
+
+func (this *KademliaNode) Maintain() {
+	this.clock.Go(func() {
+		for this.listening {
+			this.clock.Sleep(this.period)
+			if this.listening {
+				this.handOver()
+			}
+		}
+	})
+	this.clock.Go(func() {
+		for this.listening {
+			this.clock.Sleep(this.period * time.Duration(kademliaRefreshRounds))
+			if this.listening {
+				this.Refresh()
+			}
+		}
+	})
+	this.clock.Go(func() {
+		for this.listening {
+			this.clock.Sleep(this.period * time.Duration(kademliaRepublishRounds))
+			if this.listening {
+				this.Republish(false)
+			}
+		}
+	})
+}
+
+// Join learns the network from the node at addr by looking up this node, which
+// also makes the nodes it meets hand over the keys it is now close to on their
+// next round.
+func (this *KademliaNode) Join(addr string) error {
+	if !this.transport.Ping(addr) {
+		return NoRouteError
+	}
+	this.touch(addr)
+	if _, _, err := this.lookup(context.Background(), this.id, "") ; err != nil {
+		return err
+	}
+	this.Refresh()
+	return nil
+}
+
+// Quit republishes every key before the node leaves.
+func (this *KademliaNode) Quit() {
+	this.Republish(true)
+}
+
+func (this *KademliaNode) Clear() {
+	if err := this.data.Clear() ; err != nil {
+		log.Errorln("Clear: ", err)
+	}
+	this.tableLock.Lock()
+	this.table = [keySize] []string{}
+	this.arrived = nil
+	this.tableLock.Unlock()
+	this.storedLock.Lock()
+	this.stored = make(map[string] time.Time)
+	this.storedLock.Unlock()
+}
+
+func (this *KademliaNode) Dump() {
+	fmt.Printf("Dumping Kademlia node at %s.\n", this.address)
+	this.tableLock.Lock()
+	for i, bucket := range this.table {
+		if len(bucket) > 0 {
+			fmt.Printf("Bucket %d: %v\n", i, bucket)
+		}
+	}
+	this.tableLock.Unlock()
+	fmt.Print("Data: {")
+	this.data.Iterate(func(key string, content string) bool {
+		if entry := decodeEntry(content) ; !entry.Deleted {
+			fmt.Printf("{%s: %s}, ", key, entry.Value)
+		}
+		return true
+	})
+	fmt.Printf("}\n")
+}
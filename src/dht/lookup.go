@@ -0,0 +1,265 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LookupMode tells how a node finds the successor of an ID. A recursive lookup
+// hands the search from hop to hop, each keeping its call open to the next. An
+// iterative one is driven by the node which started it: it asks each hop for
+// the nodes closest to the ID, and moves on to the next of them if one does not
+// answer.
+type LookupMode int
+
+const (
+	Recursive LookupMode = iota
+	Iterative
+)
+
+func (this LookupMode) String() string {
+	if this == Iterative {
+		return "ITERATIVE"
+	}
+	return "RECURSIVE"
+}
+
+// LookupHop is the answer of a node to one step of an iterative lookup. Once
+// Done, Next holds the successor of the ID; until then, the nodes to ask next,
+// the closest preceding the ID first. Fingers tells which finger of the node
+// each of Next is, or SuccessorHop for its successor.
+type LookupHop struct {
+	Done bool
+	Next []string
+	Fingers []int
+}
+
+// SuccessorHop stands for the successor of a node in LookupHop and TraceHop.
+const SuccessorHop int = -1
+
+// NextHop answers one step of an iterative lookup. The fingers are not pinged,
+// as the node driving the lookup skips those that do not answer.
+func (this *ChordNode) NextHop(hashValue *big.Int, reply *LookupHop) error {
+	start := hashString(this.address)
+	suc := this.FirstValidSuccessor()
+	if between(start, hashValue, hashString(suc), true) {
+		*reply = LookupHop{Done: true, Next: []string{suc}, Fingers: []int{SuccessorHop}}
+		return nil
+	}
+	if owner := this.PrecedingOwner(hashValue) ; owner != "" {
+		*reply = LookupHop{Done: true, Next: []string{owner}, Fingers: []int{SuccessorHop}}
+		return nil
+	}
+	reply.Next, reply.Fingers = nil, nil
+	for i := fingerLen - 1 ; i >= 0 && len(reply.Next) < successorLen ; i -- {
+		finger := this.finger[i]
+		if finger == "" || !between(start, hashString(finger), hashValue, false) || contains(reply.Next, finger) {
+			continue
+		}
+		reply.Next = append(reply.Next, finger)
+		reply.Fingers = append(reply.Fingers, i)
+	}
+	if suc != "" && !contains(reply.Next, suc) {
+		reply.Next = append(reply.Next, suc)
+		reply.Fingers = append(reply.Fingers, SuccessorHop)
+	}
+	return nil
+}
+
+// TraceHop is a node asked during a lookup. Finger is the finger of the node
+// asked before which pointed here, or SuccessorHop; it is SuccessorHop for the
+// node the lookup starts from as well. Err is set if the node did not answer:
+// an iterative lookup goes on without it, a recursive one fails there.
+type TraceHop struct {
+	Address string
+	ID *big.Int
+	Finger int
+	Latency time.Duration
+	Err string
+}
+
+// LookupTrace tells how the successor of an ID was found. The hops of the
+// trials which failed come first, Retries of them.
+type LookupTrace struct {
+	ID *big.Int
+	Successor string
+	Mode LookupMode
+	Retries int
+	Hops []TraceHop
+}
+
+// HopCount returns the number of nodes which answered the lookup.
+func (this LookupTrace) HopCount() int {
+	count := 0
+	for _, hop := range this.Hops {
+		if hop.Err == "" {
+			count ++
+		}
+	}
+	return count
+}
+
+// Skipped returns the number of nodes which did not answer and were skipped.
+func (this LookupTrace) Skipped() int {
+	return len(this.Hops) - this.HopCount()
+}
+
+// Latency returns the time spent on all the hops.
+func (this LookupTrace) Latency() time.Duration {
+	var total time.Duration
+	for _, hop := range this.Hops {
+		total += hop.Latency
+	}
+	return total
+}
+
+// Path returns the addresses of the nodes which answered, in order.
+func (this LookupTrace) Path() []string {
+	path := make([]string, 0, len(this.Hops))
+	for _, hop := range this.Hops {
+		if hop.Err == "" {
+			path = append(path, hop.Address)
+		}
+	}
+	return path
+}
+
+func (this LookupTrace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s lookup of %x: %s in %d hops, %d skipped, %d retries, %s.\n", this.Mode, this.ID, this.Successor, this.HopCount(), this.Skipped(), this.Retries, this.Latency())
+	for i, hop := range this.Hops {
+		finger := "successor"
+		if hop.Finger != SuccessorHop {
+			finger = "finger " + strconv.Itoa(hop.Finger)
+		}
+		fmt.Fprintf(&b, "%3d  %-21s  %040x  %-10s  %s", i, hop.Address, hop.ID, finger, hop.Latency)
+		if hop.Err != "" {
+			fmt.Fprintf(&b, "  skipped: %s", hop.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// IterativeLookup finds the successor of the ID, starting from the node at
+// start, and returns it with the nodes that answered on the way.
+func (this *ChordNode) IterativeLookup(ctx context.Context, start string, hashValue *big.Int) (string, []string, error) {
+	trace, err := this.TraceLookupFrom(ctx, start, hashValue)
+	return trace.Successor, trace.Path(), err
+}
+
+// TraceLookup finds the successor of the ID from this node the way its lookup
+// mode says, and tells which nodes were asked on the way. The latency of a hop
+// of a recursive lookup is the time its call took less the hops after it.
+func (this *ChordNode) TraceLookup(ctx context.Context, hashValue *big.Int) (LookupTrace, error) {
+	if this.lookupMode == Iterative {
+		return this.TraceLookupFrom(ctx, this.address, hashValue)
+	}
+	trace := LookupTrace{ID: hashValue, Mode: Recursive}
+	begin := this.clock.Now()
+	err := this.TraceSuccessor(ctx, hashValue, &trace)
+	self := TraceHop{Address: this.address, ID: hashString(this.address), Finger: SuccessorHop, Latency: this.clock.Now().Sub(begin) - trace.Latency()}
+	trace.Hops = append([]TraceHop{self}, trace.Hops...)
+	return trace, err
+}
+
+// TraceSuccessor is FindSuccessor which adds the nodes the lookup is handed to
+// from this node on to the trace.
+func (this *ChordNode) TraceSuccessor(ctx context.Context, hashValue *big.Int, trace *LookupTrace) error {
+	if err := ctx.Err() ; err != nil {
+		return err
+	}
+	if suc := this.FirstValidSuccessor() ; between(hashString(this.address), hashValue, hashString(suc), true) {
+		trace.Successor = suc
+		return nil
+	}
+	if owner := this.PrecedingOwner(hashValue) ; owner != "" {
+		trace.Successor = owner
+		return nil
+	}
+	jump, finger := this.closestPrecedingFinger(hashValue)
+	if jump == "" {
+		return InvalidAddressError
+	}
+	var rest LookupTrace
+	begin := this.clock.Now()
+	err := this.transport.Call(ctx, jump, "RPCWrapper.TraceSuccessor", NewLookupArgs(ctx, hashValue), &rest)
+	hop := TraceHop{Address: jump, ID: hashString(jump), Finger: finger, Latency: this.clock.Now().Sub(begin) - rest.Latency()}
+	if err != nil {
+		hop.Err = err.Error()
+	}
+	trace.Hops = append(append(trace.Hops, hop), rest.Hops...)
+	trace.Successor = rest.Successor
+	return err
+}
+
+// TraceLookupFrom is TraceLookup starting from the node at start.
+func (this *ChordNode) TraceLookupFrom(ctx context.Context, start string, hashValue *big.Int) (LookupTrace, error) {
+	trace := LookupTrace{ID: hashValue, Mode: Iterative}
+	candidates, fingers := []string{start}, []int{SuccessorHop}
+	asked := make(map[string] bool)
+	for trace.HopCount() < fingerLen {
+		var reply LookupHop
+		var err error
+		answered := false
+		for i, addr := range candidates {
+			if asked[addr] {
+				continue
+			}
+			asked[addr] = true
+			begin := this.clock.Now()
+			if addr == this.address {
+				err = this.NextHop(hashValue, &reply)
+			} else {
+				err = this.transport.Call(ctx, addr, "RPCWrapper.NextHop", hashValue, &reply)
+			}
+			hop := TraceHop{Address: addr, ID: hashString(addr), Finger: SuccessorHop, Latency: this.clock.Now().Sub(begin)}
+			if i < len(fingers) {
+				hop.Finger = fingers[i]
+			}
+			if err == nil {
+				trace.Hops = append(trace.Hops, hop)
+				answered = true
+				break
+			}
+			if ctx.Err() != nil {
+				return trace, ctx.Err()
+			}
+			hop.Err = err.Error()
+			trace.Hops = append(trace.Hops, hop)
+			log.Warningf("Lookup from %s skips %s: %s.\n", this.address, addr, err)
+		}
+		if !answered {
+			if err == nil {
+				err = InvalidAddressError
+			}
+			return trace, err
+		}
+		if reply.Done {
+			trace.Successor = reply.Next[0]
+			return trace, nil
+		}
+		candidates, fingers = reply.Next, reply.Fingers
+	}
+	return trace, fmt.Errorf("%w: no successor of %x within %d hops", NoRouteError, hashValue, fingerLen)
+}
+
+// lookup finds the successor of the ID the way the lookup mode of the node
+// says. Lookups started by this node go through it; hops of recursive lookups
+// started elsewhere come in through FindSuccessor.
+func (this *ChordNode) lookup(ctx context.Context, hashValue *big.Int, succaddr *string) error {
+	if this.lookupMode != Iterative {
+		return this.FindSuccessorContext(ctx, hashValue, succaddr)
+	}
+	suc, _, err := this.IterativeLookup(ctx, this.address, hashValue)
+	if err != nil {
+		return err
+	}
+	*succaddr = suc
+	return nil
+}
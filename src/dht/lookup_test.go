@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// newTestRing serves n nodes on the network and links them into a settled
+// ring: successors, predecessors and fingers all point where maintenance would
+// have them, without any running.
+func newTestRing(t *testing.T, network *MemNetwork, n int) []*ChordNode {
+	nodes := make([]*ChordNode, n)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, network, 21000 + i)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return hashString(nodes[i].address).Cmp(hashString(nodes[j].address)) < 0
+	})
+	for i, node := range nodes {
+		for j := 0 ; j < successorLen ; j ++ {
+			node.successor[j] = nodes[(i + 1 + j) % n].address
+			node.predecessor[j] = nodes[((i - 1 - j) % n + n) % n].address
+		}
+		for k := 0 ; k < fingerLen ; k ++ {
+			node.finger[k] = ringOwner(nodes, jump(node.address, k))
+		}
+	}
+	return nodes
+}
+
+// ringOwner returns the first of the sorted nodes at or past the ID.
+func ringOwner(nodes []*ChordNode, hashValue *big.Int) string {
+	for _, node := range nodes {
+		if hashString(node.address).Cmp(hashValue) >= 0 {
+			return node.address
+		}
+	}
+	return nodes[0].address
+}
+
+func TestTraceLookup(t *testing.T) {
+	nodes := newTestRing(t, NewMemNetwork(), 16)
+	tests := []struct {
+		name string
+		mode LookupMode
+	}{
+		{name : "recursive", mode : Recursive},
+		{name : "iterative", mode : Iterative},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, node := range nodes {
+				node.lookupMode = test.mode
+			}
+			for i := 0 ; i < 20 ; i ++ {
+				id := hashString("key" + strconv.Itoa(i))
+				from := nodes[i % len(nodes)]
+				trace, err := from.TraceLookup(context.Background(), id)
+				if err != nil {
+					t.Fatalf("lookup of %x from %s: %v", id, from.address, err)
+				}
+				if trace.Mode != test.mode {
+					t.Errorf("lookup of %x traced as %s", id, trace.Mode)
+				}
+				if want := ringOwner(nodes, id) ; trace.Successor != want {
+					t.Errorf("lookup of %x from %s found %s, want %s", id, from.address, trace.Successor, want)
+				}
+				if len(trace.Hops) == 0 || trace.Hops[0].Address != from.address {
+					t.Errorf("lookup of %x from %s does not start there: %v", id, from.address, trace.Path())
+				}
+				if trace.Skipped() != 0 {
+					t.Errorf("lookup of %x skipped %d nodes of a healthy ring", id, trace.Skipped())
+				}
+				var suc string
+				if err := from.lookup(context.Background(), id, &suc) ; err != nil || suc != trace.Successor {
+					t.Errorf("lookup of %x from %s found %s, %v, the trace %s", id, from.address, suc, err, trace.Successor)
+				}
+			}
+		})
+	}
+}
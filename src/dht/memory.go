@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var UnreachableError error = errors.New("unreachable address")
+var AddressInUseError error = errors.New("address already in use")
+
+// MemNetwork is a transport that connects the nodes of one process through
+// channels instead of sockets. Separate networks never see each other, so
+// several rings can run side by side.
+type MemNetwork struct {
+	Timeout time.Duration
+
+	endpoints map[string] *memEndpoint
+	lock sync.RWMutex
+}
+
+type memCall struct {
+	method string
+	args interface{}
+	reply interface{}
+	done chan error
+}
+
+type memEndpoint struct {
+	service interface{}
+	calls chan *memCall
+	quit chan struct{}
+	network *MemNetwork
+	address string
+	once sync.Once
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		Timeout : maintainPeriod * 3,
+		endpoints : make(map[string] *memEndpoint),
+	}
+}
+
+func (this *MemNetwork) Serve(address string, service interface{}) (io.Closer, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.endpoints[address] ; ok {
+		return nil, AddressInUseError
+	}
+	ep := &memEndpoint{
+		service : service,
+		calls : make(chan *memCall),
+		quit : make(chan struct{}),
+		network : this,
+		address : address,
+	}
+	this.endpoints[address] = ep
+	go ep.serve()
+	return ep, nil
+}
+
+func (this *MemNetwork) endpoint(address string) *memEndpoint {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.endpoints[address]
+}
+
+func (this *MemNetwork) Call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	if address == "" {
+		return InvalidAddressError
+	}
+	ep := this.endpoint(address)
+	if ep == nil {
+		return UnreachableError
+	}
+	call := &memCall{method: method, args: args, reply: reply, done: make(chan error, 1)}
+	timeout := defaultTimeout(ctx, this.Timeout)
+	select {
+	case ep.calls <- call :
+	case <- ep.quit :
+		return UnreachableError
+	case <- ctx.Done() :
+		return ctx.Err()
+	case <- timeout :
+		return TimeOutError
+	}
+	select {
+	case err := <- call.done :
+		return err
+	case <- ctx.Done() :
+		return ctx.Err()
+	case <- timeout :
+		return TimeOutError
+	}
+}
+
+func (this *MemNetwork) Ping(address string) bool {
+	return address != "" && this.endpoint(address) != nil
+}
+
+func (this *memEndpoint) serve() {
+	for {
+		select {
+		case call := <- this.calls :
+			go func() {
+				call.done <- dispatchCall(this.service, call.method, call.args, call.reply)
+			}()
+		case <- this.quit :
+			return
+		}
+	}
+}
+
+func (this *memEndpoint) Close() error {
+	this.once.Do(func() {
+		this.network.lock.Lock()
+		delete(this.network.endpoints, this.address)
+		this.network.lock.Unlock()
+		close(this.quit)
+	})
+	return nil
+}
+
+// dispatchCall invokes the method on the service the way net/rpc does:
+// arguments and replies are copied, so no map or slice is shared between two
+// nodes.
+func dispatchCall(service interface{}, methodName string, args interface{}, reply interface{}) error {
+	dot := strings.LastIndex(methodName, ".")
+	if dot < 0 || methodName[: dot] != serviceName(service) {
+		return errors.New("rpc: can't find service " + methodName)
+	}
+	method := reflect.ValueOf(service).MethodByName(methodName[dot + 1 :])
+	if !method.IsValid() {
+		return errors.New("rpc: can't find method " + methodName)
+	}
+	argv := reflect.New(method.Type().In(0))
+	if err := copyValue(args, argv.Interface()) ; err != nil {
+		return err
+	}
+	replyv := reflect.New(method.Type().In(1).Elem())
+	out := method.Call([]reflect.Value{argv.Elem(), replyv})
+	if err, _ := out[0].Interface().(error) ; err != nil {
+		return rpc.ServerError(err.Error())
+	}
+	if reply == nil {
+		return nil
+	}
+	return copyValue(replyv.Interface(), reply)
+}
+
+func copyValue(src interface{}, dst interface{}) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(src) ; err != nil {
+		return err
+	}
+	return gob.NewDecoder(&buffer).Decode(dst)
+}
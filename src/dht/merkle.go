@@ -0,0 +1,230 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The Merkle trees compared by anti-entropy have merkleFanout children per node
+// and merkleDepth levels below the root. The range compared is split evenly
+// into the 1 << merkleBucketBits buckets at the bottom, so that however little
+// of the ring it covers, one differing key only ships its share of the range.
+const merkleFanout int = 16
+const merkleDepth int = 2
+const merkleBucketBits int = 8
+
+// antiEntropyRounds is the number of maintenance periods between two
+// anti-entropy rounds.
+const antiEntropyRounds int = 8
+
+var emptyBucketHash = sha1.New().Sum(nil)
+
+// merkleTree keeps the hashes of each level, the root first and the buckets
+// last.
+type merkleTree [merkleDepth + 1][][]byte
+
+// merkleBucket returns the bucket of the key among those splitting
+// (start, end], by the offset of its hash within the range.
+func merkleBucket(key string, start, end *big.Int) int {
+	size := new(big.Int).Sub(end, start)
+	if size.Sign() <= 0 {
+		size.Add(size, hashMod)
+	}
+	offset := new(big.Int).Sub(hashString(key), start)
+	offset.Sub(offset, big.NewInt(1)).Mod(offset, hashMod)
+	offset.Lsh(offset, uint(merkleBucketBits)).Div(offset, size)
+	return int(offset.Int64())
+}
+
+// buildMerkleTree hashes the entries of store whose key hashes into
+// (start, end].
+func buildMerkleTree(store Store, start, end *big.Int) *merkleTree {
+	buckets := make([][]string, 1 << merkleBucketBits)
+	entries := store.Range(start, end)
+	for key := range entries {
+		bucket := merkleBucket(key, start, end)
+		buckets[bucket] = append(buckets[bucket], key)
+	}
+	tree := new(merkleTree)
+	tree[merkleDepth] = make([][]byte, len(buckets))
+	for i, keys := range buckets {
+		if len(keys) == 0 {
+			tree[merkleDepth][i] = emptyBucketHash
+			continue
+		}
+		sort.Strings(keys)
+		hasher := sha1.New()
+		for _, key := range keys {
+			hasher.Write([]byte(key))
+			hasher.Write([]byte{0})
+			hasher.Write([]byte(entries[key]))
+			hasher.Write([]byte{0})
+		}
+		tree[merkleDepth][i] = hasher.Sum(nil)
+	}
+	for level := merkleDepth - 1 ; level >= 0 ; level -- {
+		tree[level] = make([][]byte, len(tree[level + 1]) / merkleFanout)
+		for i := range tree[level] {
+			hasher := sha1.New()
+			for _, child := range tree[level + 1][i * merkleFanout : (i + 1) * merkleFanout] {
+				hasher.Write(child)
+			}
+			tree[level][i] = hasher.Sum(nil)
+		}
+	}
+	return tree
+}
+
+// MerkleQuery asks for the hashes of some nodes at one level of the tree over
+// (Start, End], in the comparison Round of Owner.
+type MerkleQuery struct {
+	Owner string
+	Round uint64
+	Start, End *big.Int
+	Level int
+	Nodes []int
+}
+
+// merkleCached is the tree a replica built for the current round of an owner.
+type merkleCached struct {
+	round uint64
+	tree *merkleTree
+	used time.Time
+}
+
+// MerkleRepair carries the entries the owner keeps in some buckets of
+// (Start, End].
+type MerkleRepair struct {
+	Start, End *big.Int
+	Buckets []int
+	Entries map[string] string
+}
+
+func (this *ChordNode) MerkleHashes(query MerkleQuery, hashes *[][]byte) error {
+	tree := this.replicaTree(query)
+	*hashes = make([][]byte, len(query.Nodes))
+	for i, node := range query.Nodes {
+		(*hashes)[i] = tree[query.Level][node]
+	}
+	return nil
+}
+
+// replicaTree returns the tree of the replicas compared by query. It is built
+// when a round starts at the root, and kept for the deeper levels. Trees of
+// owners which stopped comparing are dropped after two rounds.
+func (this *ChordNode) replicaTree(query MerkleQuery) *merkleTree {
+	this.merkleLock.Lock()
+	defer this.merkleLock.Unlock()
+	now := this.clock.Now()
+	if cached, ok := this.merkleTrees[query.Owner] ; ok && query.Level > 0 && cached.round == query.Round {
+		cached.used = now
+		return cached.tree
+	}
+	tree := buildMerkleTree(this.backup, query.Start, query.End)
+	this.merkleTrees[query.Owner] = &merkleCached{round: query.Round, tree: tree, used: now}
+	for owner, cached := range this.merkleTrees {
+		if now.Sub(cached.used) > 2 * time.Duration(antiEntropyRounds) * this.period {
+			delete(this.merkleTrees, owner)
+		}
+	}
+	return tree
+}
+
+// SyncBuckets merges the entries of the owner into the replicas of the given
+// buckets and returns the merged replicas, so that the owner picks up the
+// versions and keys it lacked in turn.
+func (this *ChordNode) SyncBuckets(repair MerkleRepair, merged *map[string] string) error {
+	if err := this.mergeInto(this.backup, repair.Entries) ; err != nil {
+		return err
+	}
+	*merged = bucketEntries(this.backup, repair.Start, repair.End, repair.Buckets)
+	return nil
+}
+
+// bucketEntries returns the entries of store in (start, end] falling into the
+// given buckets.
+func bucketEntries(store Store, start, end *big.Int, buckets []int) map[string] string {
+	wanted := make(map[int] bool)
+	for _, bucket := range buckets {
+		wanted[bucket] = true
+	}
+	entries := store.Range(start, end)
+	for key := range entries {
+		if !wanted[merkleBucket(key, start, end)] {
+			delete(entries, key)
+		}
+	}
+	return entries
+}
+
+// syncReplica compares tree, over the keys in (start, end] held by this node,
+// with the tree of the replica at addr, descending only into the subtrees that
+// differ, and repairs the buckets found to differ.
+func (this *ChordNode) syncReplica(addr string, round uint64, start, end *big.Int, tree *merkleTree) error {
+	nodes := []int{0}
+	for level := 0 ; ; level ++ {
+		var hashes [][]byte
+		query := MerkleQuery{Owner: this.address, Round: round, Start: start, End: end, Level: level, Nodes: nodes}
+		if err := this.transport.Call(context.Background(), addr, "RPCWrapper.MerkleHashes", query, &hashes) ; err != nil {
+			return err
+		}
+		var differing []int
+		for i, node := range nodes {
+			if !bytes.Equal(tree[level][node], hashes[i]) {
+				differing = append(differing, node)
+			}
+		}
+		if len(differing) == 0 {
+			return nil
+		}
+		if level == merkleDepth {
+			nodes = differing
+			break
+		}
+		nodes = nodes[: 0]
+		for _, node := range differing {
+			for child := 0 ; child < merkleFanout ; child ++ {
+				nodes = append(nodes, node * merkleFanout + child)
+			}
+		}
+	}
+	repair := MerkleRepair{Start: start, End: end, Buckets: nodes, Entries: bucketEntries(this.data, start, end, nodes)}
+	var merged map[string] string
+	if err := this.transport.Call(context.Background(), addr, "RPCWrapper.SyncBuckets", repair, &merged) ; err != nil {
+		return err
+	}
+	log.Tracef("Node %s repairs %d buckets on %s.\n", this.address, len(nodes), addr)
+	return this.mergeInto(this.data, merged)
+}
+
+// AntiEntropy brings the replicas of the keys owned by this node and its data
+// in line with each other. It returns false if some replica could not be
+// reached or the range owned is not known yet. The tree of the data is built
+// once a round, so what one replica repairs on this node reaches the others
+// on the next round.
+func (this *ChordNode) AntiEntropy(chain []string) bool {
+	pred := this.firstPredecessor()
+	if !this.listening || pred == "" {
+		return false
+	}
+	start, end := hashString(pred), hashString(this.address)
+	round := atomic.AddUint64(&this.merkleRound, 1)
+	tree := buildMerkleTree(this.data, start, end)
+	done := true
+	for _, addr := range chain {
+		if addr == "" || addr == this.address {
+			break
+		}
+		if err := this.syncReplica(addr, round, start, end, tree) ; err != nil {
+			log.Errorln("AntiEntropy: ", err)
+			done = false
+		}
+	}
+	return done
+}
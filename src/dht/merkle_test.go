@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// newTestNode serves a node of its own on network, outside any ring.
+func newTestNode(t *testing.T, network *MemNetwork, port int) *ChordNode {
+	node := NewChordNode(port, network)
+	listener, err := network.Serve(node.address, &RPCWrapper{node})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	node.listening = true
+	return node
+}
+
+func version(value string, clock VectorClock) string {
+	return encodeSiblings(Siblings{{Value: value, Clock: clock}})
+}
+
+func TestSyncReplica(t *testing.T) {
+	tests := []struct {
+		name string
+		data, backup map[string] string
+		want map[string] string
+	}{
+		{
+			name : "in sync",
+			data : map[string] string{"a": version("1", VectorClock{"o": 1})},
+			backup : map[string] string{"a": version("1", VectorClock{"o": 1})},
+			want : map[string] string{"a": version("1", VectorClock{"o": 1})},
+		},
+		{
+			name : "missing replica",
+			data : map[string] string{"a": version("1", VectorClock{"o": 1}), "b": version("2", VectorClock{"o": 2})},
+			backup : map[string] string{"a": version("1", VectorClock{"o": 1})},
+			want : map[string] string{"a": version("1", VectorClock{"o": 1}), "b": version("2", VectorClock{"o": 2})},
+		},
+		{
+			name : "stale replica",
+			data : map[string] string{"a": version("new", VectorClock{"o": 2})},
+			backup : map[string] string{"a": version("old", VectorClock{"o": 1})},
+			want : map[string] string{"a": version("new", VectorClock{"o": 2})},
+		},
+		{
+			name : "owner lacks a key",
+			data : map[string] string{},
+			backup : map[string] string{"a": version("1", VectorClock{"r": 1})},
+			want : map[string] string{"a": version("1", VectorClock{"r": 1})},
+		},
+		{
+			name : "concurrent versions",
+			data : map[string] string{"a": version("x", VectorClock{"o": 1})},
+			backup : map[string] string{"a": version("y", VectorClock{"r": 1})},
+			want : map[string] string{"a": encodeSiblings(Siblings{{Value: "x", Clock: VectorClock{"o": 1}}, {Value: "y", Clock: VectorClock{"r": 1}}})},
+		},
+	}
+	for _, test := range tests {
+		network := NewMemNetwork()
+		owner, replica := newTestNode(t, network, 20001), newTestNode(t, network, 20002)
+		owner.data.PutAll(test.data)
+		replica.backup.PutAll(test.backup)
+		// A range from an ID to itself is the whole ring.
+		whole := hashString("anything")
+		tree := buildMerkleTree(owner.data, whole, whole)
+		if err := owner.syncReplica(replica.address, 1, whole, whole, tree) ; err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := entriesOf(replica.backup) ; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: replica holds %v, want %v", test.name, got, test.want)
+		}
+		if got := entriesOf(owner.data) ; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: owner holds %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMerkleTreeBuckets(t *testing.T) {
+	whole := hashString("anything")
+	node := hashString("node")
+	tests := []struct {
+		name string
+		start, end *big.Int
+	}{
+		// A range from an ID to itself is the whole ring.
+		{name : "whole ring", start : whole, end : whole},
+		{name : "fiftieth of the ring", start : node, end : new(big.Int).Add(node, new(big.Int).Div(hashMod, big.NewInt(50)))},
+		{name : "range past zero", start : new(big.Int).Sub(hashMod, big.NewInt(1 << 20)), end : new(big.Int).Div(hashMod, big.NewInt(100))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewMemStore()
+			b := NewMemStore()
+			var keys []string
+			for i := 0 ; len(keys) < 1000 ; i ++ {
+				key := "key" + strconv.Itoa(i)
+				if between(test.start, hashString(key), test.end, true) {
+					keys = append(keys, key)
+					a.Put(key, key)
+					b.Put(key, key)
+				}
+			}
+			changed := keys[0]
+			b.Put(changed, "changed")
+			treeA := buildMerkleTree(a, test.start, test.end)
+			treeB := buildMerkleTree(b, test.start, test.end)
+			if bytes.Equal(treeA[0][0], treeB[0][0]) {
+				t.Fatal("roots equal although a value differs")
+			}
+			used := 0
+			for i := range treeA[merkleDepth] {
+				differs := !bytes.Equal(treeA[merkleDepth][i], treeB[merkleDepth][i])
+				if differs != (i == merkleBucket(changed, test.start, test.end)) {
+					t.Errorf("bucket %d differs: %v", i, differs)
+				}
+				if !bytes.Equal(treeA[merkleDepth][i], emptyBucketHash) {
+					used ++
+				}
+			}
+			// 1000 keys spread over 256 buckets leave few empty, and about 4
+			// in each.
+			if used < 200 {
+				t.Errorf("keys fall into %d buckets only", used)
+			}
+			shipped := bucketEntries(b, test.start, test.end, []int{merkleBucket(changed, test.start, test.end)})
+			if len(shipped) > 16 {
+				t.Errorf("repairing one key ships %d", len(shipped))
+			}
+		})
+	}
+}
+
+func TestReplicaTreeReusedWithinRound(t *testing.T) {
+	node := NewChordNode(20003, NewMemNetwork())
+	whole := hashString("anything")
+	node.backup.Put("a", "1")
+	// The node above the bucket of "a", one level up.
+	parent := merkleBucket("a", whole, whole) / merkleFanout
+	hashes := func(round uint64, level int) []byte {
+		var reply [][]byte
+		query := MerkleQuery{Owner: "owner", Round: round, Start: whole, End: whole, Level: level, Nodes: []int{0}}
+		if level > 0 {
+			query.Nodes = []int{parent}
+		}
+		if err := node.MerkleHashes(query, &reply) ; err != nil {
+			t.Fatal(err)
+		}
+		return reply[0]
+	}
+	hashes(1, 0)
+	before := hashes(1, 1)
+	node.backup.Put("a", "2")
+	if !bytes.Equal(hashes(1, 1), before) {
+		t.Error("tree rebuilt within a round")
+	}
+	hashes(2, 0)
+	if bytes.Equal(hashes(2, 1), before) {
+		t.Error("tree not rebuilt for a new round")
+	}
+}
@@ -0,0 +1,284 @@
+package dht
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"sort"
+)
+
+// partitionRounds is the number of maintenance periods between two checks for
+// a ring split off from this one.
+const partitionRounds int = 8
+
+// maxMembers is the number of members a node remembers having seen.
+const maxMembers int = 64
+
+// remember adds addr to the members seen by this node, forgetting the one seen
+// longest ago if there are too many.
+func (this *ChordNode) remember(addr string) {
+	if addr == "" || addr == this.address {
+		return
+	}
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	for i, member := range this.members {
+		if member == addr {
+			this.members = append(this.members[: i], this.members[i + 1 :]...)
+			break
+		}
+	}
+	this.members = append(this.members, addr)
+	if len(this.members) > maxMembers {
+		this.members = this.members[len(this.members) - maxMembers :]
+	}
+}
+
+// Members returns the nodes this node remembers having seen on its ring.
+func (this *ChordNode) Members() []string {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	return append([]string(nil), this.members...)
+}
+
+// nextMember returns the members one after another, round-robin.
+func (this *ChordNode) nextMember() string {
+	this.memberLock.Lock()
+	defer this.memberLock.Unlock()
+	if len(this.members) == 0 {
+		return ""
+	}
+	this.memberCursor = (this.memberCursor + 1) % len(this.members)
+	return this.members[this.memberCursor]
+}
+
+// closestLiveNode returns the live node following this one most closely among
+// its predecessors, fingers and remembered members, or "" if none is alive. It
+// stands in for the successor once the whole successor list has failed, as a
+// partition may take all of it to the far side, so that each side still closes
+// into a ring of its own, which CheckPartition merges back once it heals.
+func (this *ChordNode) closestLiveNode() string {
+	this.predLock.RLock()
+	candidates := append([]string(nil), this.predecessor[:]...)
+	this.predLock.RUnlock()
+	candidates = append(candidates, this.finger[:]...)
+	candidates = append(candidates, this.Members()...)
+	start := hashString(this.address)
+	distance := func(addr string) *big.Int {
+		d := new(big.Int).Sub(hashString(addr), start)
+		return d.Mod(d, hashMod)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return distance(candidates[i]).Cmp(distance(candidates[j])) < 0
+	})
+	for i, addr := range candidates {
+		if addr == "" || addr == this.address || (i > 0 && addr == candidates[i - 1]) {
+			continue
+		}
+		if this.alive(addr) {
+			return addr
+		}
+	}
+	return ""
+}
+
+// CheckPartition takes the next remembered member and, if it is alive but the
+// ring of this node no longer finds it, as happens once a network partition
+// heals after both sides have stabilized, merges its ring into this one.
+func (this *ChordNode) CheckPartition() {
+	addr := this.nextMember()
+	if addr == "" || !this.transport.Ping(addr) {
+		return
+	}
+	var owner string
+	if err := this.lookup(context.Background(), hashString(addr), &owner) ; err != nil {
+		log.Errorln("CheckPartition: ", err)
+		return
+	}
+	if owner == addr {
+		return
+	}
+	log.Warningf("Node %s finds %s alive off its ring, whose lookup ends at %s.\n", this.address, addr, owner)
+	if err := this.MergeRing(addr) ; err != nil {
+		log.Errorln("CheckPartition: ", err)
+	}
+}
+
+// MergeRing starts merging the ring of addr into the ring of this node. The
+// node looks itself up on the other ring, and takes the node found there as
+// its successor if it is closer than its own, and notifies it either way.
+// Stabilization then zips the two rings together node by node, each node
+// handing the keys it no longer owns over to its new predecessor, where their
+// versions merge with those already there. Concurrent values of a key end up
+// as siblings, see GetVersions.
+func (this *ChordNode) MergeRing(addr string) error {
+	var suc string
+	if err := this.transport.Call(context.Background(), addr, "RPCWrapper.FindSuccessor", LookupArgs{ID: hashString(this.address)}, &suc) ; err != nil {
+		return err
+	}
+	if suc == "" || suc == this.address {
+		return nil
+	}
+	var list [successorLen] string
+	if err := this.transport.Call(context.Background(), suc, "RPCWrapper.GetSuccessor", 0, &list) ; err != nil {
+		return err
+	}
+	this.succLock.Lock()
+	first := this.successor[0]
+	if first == "" || first == this.address || between(hashString(this.address), hashString(suc), hashString(first), false) {
+		this.successor[0] = suc
+		for i := 1 ; i < successorLen ; i ++ {
+			this.successor[i] = list[i - 1]
+		}
+		log.Tracef("The successor of node %s has been changed to %s of another ring.\n", this.address, suc)
+	}
+	this.succLock.Unlock()
+	if err := this.transport.Call(context.Background(), suc, "RPCWrapper.Notify", this.address, nil) ; err != nil {
+		return err
+	}
+	this.clock.Go(this.RefreshFingers)
+	return nil
+}
+
+// RefreshFingers looks every finger up again, as after a merge most of them
+// point past closer nodes of the other ring.
+func (this *ChordNode) RefreshFingers() {
+	for i := 0 ; i < fingerLen && this.listening ; i ++ {
+		var finger string
+		if err := this.lookup(context.Background(), jump(this.address, i), &finger) ; err != nil {
+			log.Errorln("RefreshFingers: ", err)
+			continue
+		}
+		this.finger[i] = finger
+	}
+}
+
+// HandOff hands the keys between the former predecessor and the one a Notify
+// put in its place over to the latter. Notify only records the change, so that
+// it does not call back the node notifying it; most of the keys have already
+// moved when that node joined, see SplitIntoPredecessor, but not those of a
+// ring being merged. A failed handoff is tried again on the next round.
+func (this *ChordNode) HandOff() {
+	this.predLock.Lock()
+	from, to := this.handoff, this.predecessor[0]
+	this.handoff = ""
+	this.predLock.Unlock()
+	if from == "" || to == "" || to == this.address || !between(hashString(from), hashString(to), hashString(this.address), false) {
+		return
+	}
+	if err := this.handOver(from, to) ; err != nil {
+		log.Errorln("HandOff: ", err)
+		this.predLock.Lock()
+		if this.handoff == "" {
+			this.handoff = from
+		}
+		this.predLock.Unlock()
+	}
+}
+
+// handOver moves the keys in (from, to] to the node at to, which has become
+// the predecessor, keeping them as replicas. A key written while the call was
+// on its way is kept, to be handed over on a later round.
+func (this *ChordNode) handOver(from, to string) error {
+	this.dataLock.Lock()
+	entries := this.data.Range(hashString(from), hashString(to))
+	this.dataLock.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	handover := ReplicaData{Owner: this.address, Data: entries, Remain: successorLen}
+	if err := this.transport.Call(context.Background(), to, "RPCWrapper.MergeData", handover, nil) ; err != nil {
+		return err
+	}
+	this.dataLock.Lock()
+	defer this.dataLock.Unlock()
+	if err := this.mergeLocked(this.backup, entries) ; err != nil {
+		log.Errorln("handOver: ", err)
+	}
+	log.Tracef("Node %s hands %d keys over to %s.\n", this.address, this.dropUnchanged(entries), to)
+	return nil
+}
+
+// dropUnchanged deletes the entries from the data of a caller holding dataLock,
+// except those written since, and returns how many it deleted.
+func (this *ChordNode) dropUnchanged(entries map[string] string) int {
+	var unchanged []string
+	for key, content := range entries {
+		if current, ok := this.data.Get(key) ; ok && current == content {
+			unchanged = append(unchanged, key)
+		}
+	}
+	if err := this.data.DeleteAll(unchanged) ; err != nil {
+		log.Errorln("dropUnchanged: ", err)
+	}
+	return len(unchanged)
+}
+
+// HandOffStrays hands the keys this node holds outside its own range over to
+// the nodes a lookup finds owning them. Keys end up so when a write follows a
+// lookup which still ends here, or when a merged ring passes keys back further
+// than MergeData goes.
+func (this *ChordNode) HandOffStrays() {
+	pred := this.firstPredecessor()
+	if pred == "" || pred == this.address {
+		return
+	}
+	this.dataLock.Lock()
+	strays := this.data.Range(hashString(this.address), hashString(pred))
+	this.dataLock.Unlock()
+	owned := make(map[string] map[string] string)
+	for key, content := range strays {
+		var owner string
+		if err := this.lookup(context.Background(), hashString(key), &owner) ; err != nil {
+			log.Errorln("HandOffStrays: ", err)
+			return
+		}
+		if owner == "" || owner == this.address {
+			continue
+		}
+		if owned[owner] == nil {
+			owned[owner] = make(map[string] string)
+		}
+		owned[owner][key] = content
+	}
+	for owner, entries := range owned {
+		handover := ReplicaData{Owner: this.address, Data: entries, Remain: successorLen}
+		if err := this.transport.Call(context.Background(), owner, "RPCWrapper.MergeData", handover, nil) ; err != nil {
+			log.Errorln("HandOffStrays: ", err)
+			continue
+		}
+		this.dataLock.Lock()
+		log.Tracef("Node %s hands %d stray keys over to %s.\n", this.address, this.dropUnchanged(entries), owner)
+		this.dataLock.Unlock()
+	}
+}
+
+// MergeData takes over keys from a node which found that they belong here, and
+// replicates them. Keys before the predecessor, which the ring being merged
+// may have put in between, go on to it, at most Remain nodes back.
+func (this *ChordNode) MergeData(handover ReplicaData, _ *int) error {
+	mine, further := handover.Data, map[string] string(nil)
+	if pred := this.firstPredecessor() ; pred != "" && pred != handover.Owner && handover.Remain > 1 {
+		mine = make(map[string] string)
+		further = make(map[string] string)
+		start, end := hashString(pred), hashString(this.address)
+		for key, content := range handover.Data {
+			if between(start, hashString(key), end, true) {
+				mine[key] = content
+			} else {
+				further[key] = content
+			}
+		}
+		if len(further) > 0 {
+			onward := ReplicaData{Owner: handover.Owner, Data: further, Remain: handover.Remain - 1}
+			if err := this.transport.Call(context.Background(), pred, "RPCWrapper.MergeData", onward, nil) ; err != nil {
+				log.Errorln("MergeData: ", err)
+				mine = handover.Data
+			}
+		}
+	}
+	if err := this.mergeInto(this.data, mine) ; err != nil {
+		return err
+	}
+	return this.replicate(mine)
+}
@@ -0,0 +1,143 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHandOff(t *testing.T) {
+	tests := []struct {
+		name string
+		notify bool
+		want bool // whether the keys end up on the new predecessor
+	}{
+		{name : "new predecessor", notify : true, want : true},
+		{name : "no notify", notify : false, want : false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := newTestRing(t, NewMemNetwork(), 3)
+			node, joined := nodes[2], nodes[1]
+			node.predecessor = [successorLen] string{nodes[0].address}
+			keys := make(map[string] string)
+			for i := 0 ; len(keys) < 5 ; i ++ {
+				key := "key" + strconv.Itoa(i)
+				if between(hashString(nodes[0].address), hashString(key), hashString(joined.address), true) {
+					keys[key] = version(key, VectorClock{"o": 1})
+				}
+			}
+			if err := node.data.PutAll(keys) ; err != nil {
+				t.Fatal(err)
+			}
+			if test.notify {
+				if err := node.Notify(joined.address, nil) ; err != nil {
+					t.Fatal(err)
+				}
+				if node.data.Len() != len(keys) {
+					t.Errorf("Notify moved keys before the handoff")
+				}
+			}
+			node.HandOff()
+			for key := range keys {
+				_, moved := joined.data.Get(key)
+				_, kept := node.data.Get(key)
+				_, backup := node.backup.Get(key)
+				if moved != test.want || kept == test.want || backup != test.want {
+					t.Errorf("%s: on the new predecessor %v, in data %v, in backup %v", key, moved, kept, backup)
+				}
+			}
+		})
+	}
+}
+
+// newFaultyRing joins n nodes of the simulator into one ring, calling each
+// other through the injector. They are returned in ring order. It must be
+// called from a simulated goroutine.
+func newFaultyRing(t *testing.T, sim *Simulator, injector *FaultInjector, n int) []*DHTNode {
+	nodes := make([]*DHTNode, n)
+	for i := range nodes {
+		port := 23000 + i
+		nodes[i] = &DHTNode{}
+		nodes[i].SetPortWithTransport(port, injector.Transport(GetLocalAddress() + ":" + strconv.Itoa(port)))
+		nodes[i].SetClock(sim)
+		nodes[i].Run()
+		if i > 0 && !nodes[i].Join(nodes[0].node.address) {
+			t.Errorf("node %d failed to join", i)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return hashString(nodes[i].node.address).Cmp(hashString(nodes[j].node.address)) < 0
+	})
+	return nodes
+}
+
+// checkRing walks the ring from node and reports unless it is strongly stable
+// with size nodes.
+func checkRing(t *testing.T, what string, node *DHTNode, size int) {
+	health, err := node.node.WalkRing(context.Background())
+	if err != nil || !health.StronglyStable() || health.Nodes != size {
+		t.Errorf("%s: walk from %s finds %s, %v; want %d nodes", what, node.node.address, health, err, size)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		name string
+		side func(i int, n int) int // the side of the i'th node of n in ring order
+	}{
+		// The last node of each half has all its successors on the far side.
+		{name : "halves", side : func(i int, n int) int { return i * 2 / n }},
+		{name : "interleaved", side : func(i int, n int) int { return i % 2 }},
+		{name : "uneven", side : func(i int, n int) int { return i * 3 / n / 2 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := NewSimulator(1)
+			injector := NewFaultInjector(sim, sim, 1)
+			sim.Run(func() {
+				nodes := newFaultyRing(t, sim, injector, 10)
+				var keys []string
+				for i := 0 ; i < 20 ; i ++ {
+					keys = append(keys, "key" + strconv.Itoa(i))
+					if !nodes[i % len(nodes)].Put(keys[i], "before") {
+						t.Errorf("put of %s failed", keys[i])
+					}
+				}
+				var sides [2][]*DHTNode
+				var groups [2][]string
+				for i, node := range nodes {
+					side := test.side(i, len(nodes))
+					sides[side] = append(sides[side], node)
+					groups[side] = append(groups[side], node.node.address)
+				}
+				injector.Partition(groups[0], groups[1])
+				sim.Sleep(30 * time.Second)
+				for i, side := range sides {
+					checkRing(t, "split", side[0], len(side))
+					// Each side takes writes of its own.
+					for j := 0 ; j < 5 ; j ++ {
+						key := "side" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+						if !side[j % len(side)].Put(key, "split") {
+							t.Errorf("put of %s failed on side %d", key, i)
+						}
+						if ok, _ := side[(j + 1) % len(side)].Get(key) ; !ok {
+							t.Errorf("get of %s failed on side %d", key, i)
+						}
+						keys = append(keys, key)
+					}
+				}
+				injector.Heal()
+				sim.Sleep(60 * time.Second)
+				checkRing(t, "healed", nodes[0], len(nodes))
+				for i, key := range keys {
+					if ok, _ := nodes[i % len(nodes)].Get(key) ; !ok {
+						t.Errorf("%s lost to the partition", key)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,903 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pastry reads IDs as digits of pastryB bits, so that the routing table has
+// pastryRows rows of pastryCols entries.
+const pastryB int = 4
+const pastryRows int = keySize / pastryB
+const pastryCols int = 1 << pastryB
+
+// The leaf set holds the pastryLeafHalf nodes numerically closest on either
+// side of the node, and the neighbourhood set the pastryNeighbours nodes with
+// the shortest round trip.
+const pastryLeafHalf int = 8
+const pastryNeighbours int = 16
+
+// pastryMaxHops bounds a route, which takes one hop per digit at most, then a
+// few within the leaf set.
+const pastryMaxHops int = 2 * pastryRows
+
+// Keys are stored on defaultPastryReplicas nodes of the leaf set unless set,
+// and replicated again every pastryReplicateRounds maintenance periods.
+// Contacts which failed are not learnt again from other nodes for
+// pastryForgetRounds periods.
+const defaultPastryReplicas int = 5
+const pastryReplicateRounds int = 8
+const pastryForgetRounds int = 16
+
+// digit returns the digit of id in the given row of the routing table, the
+// most significant one in row 0.
+func digit(id *big.Int, row int) int {
+	shifted := new(big.Int).Rsh(id, uint(keySize - pastryB * (row + 1)))
+	return int(shifted.Int64() & int64(pastryCols - 1))
+}
+
+func sharedPrefix(a, b *big.Int) int {
+	for row := 0 ; row < pastryRows ; row ++ {
+		if digit(a, row) != digit(b, row) {
+			return row
+		}
+	}
+	return pastryRows
+}
+
+// clockwise is the distance from a forward to b around the ring.
+func clockwise(a, b *big.Int) *big.Int {
+	return new(big.Int).Mod(new(big.Int).Sub(b, a), hashMod)
+}
+
+// ringDistance is the numeric distance between a and b, either way around the
+// ring.
+func ringDistance(a, b *big.Int) *big.Int {
+	forward := clockwise(a, b)
+	if backward := clockwise(b, a) ; backward.Cmp(forward) < 0 {
+		return backward
+	}
+	return forward
+}
+
+// sortByRing sorts the addresses by their numeric distance to id, the closest
+// first.
+func sortByRing(addrs []string, id *big.Int) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return ringDistance(hashString(addrs[i]), id).Cmp(ringDistance(hashString(addrs[j]), id)) < 0
+	})
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, elt := range addrs {
+		if elt == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteArgs routes a lookup to the node numerically closest to its ID, after
+// Hops hops.
+type RouteArgs struct {
+	LookupArgs
+	Hops int
+}
+
+// StateArgs asks a node for its state and its next hop towards ID. From is
+// the node asking, or empty for a node still joining.
+type StateArgs struct {
+	From string
+	ID *big.Int
+}
+
+// PastryState is what a node knows: its leaf set, the entries of its routing
+// table and its neighbourhood set, and its next hop towards the ID asked for,
+// itself if it is the closest node.
+type PastryState struct {
+	Leaves []string
+	Routes []string
+	Neighbours []string
+	Next string
+}
+
+// PastryStoreArgs carries encoded entries from the node at From. With
+// Replicate, the node passes them on to the rest of the replicas.
+type PastryStoreArgs struct {
+	From string
+	Entries map[string] string
+	Replicate bool
+	Budget time.Duration
+}
+
+// FetchArgs asks for the entry of Key. With Forward, a node without it asks the
+// rest of the replicas.
+type FetchArgs struct {
+	Key string
+	Forward bool
+	Budget time.Duration
+}
+
+// budgeted are the arguments of calls which bound the onward calls they make
+// by the caller's deadline. call fills the budget in as it sends them.
+type budgeted interface {
+	withBudget(budget time.Duration) interface{}
+}
+
+func (this PastryStoreArgs) withBudget(budget time.Duration) interface{} {
+	this.Budget = budget
+	return this
+}
+
+func (this FetchArgs) withBudget(budget time.Duration) interface{} {
+	this.Budget = budget
+	return this
+}
+
+type FetchReply struct {
+	Found bool
+	Entry StampedEntry
+}
+
+// PastryNode is a node of a Pastry network: it routes by ID prefix through its
+// routing table, and keeps each key on the nodes numerically closest to it,
+// which are in each other's leaf sets.
+type PastryNode struct {
+	stampedBase
+
+	// smaller and larger are the two halves of the leaf set, the closest node
+	// first. In a small network a node may be on both.
+	smaller []string
+	larger []string
+	table [pastryRows][pastryCols] string
+	neighbours []string
+	// rtt is the proximity metric: the round trip last measured to a contact.
+	rtt map[string] time.Duration
+	dead map[string] time.Time
+	// arrived are the leaves learnt since the last handover.
+	arrived []string
+	turn int
+	lock sync.Mutex
+}
+
+func NewPastryNode(port int, transport Transport) *PastryNode {
+	address := GetLocalAddress() + ":" + strconv.Itoa(port)
+	return &PastryNode {
+		stampedBase : stampedBase{
+			address : address,
+			id : hashString(address),
+			transport : transport,
+			clock : DefaultClock,
+			period : maintainPeriod,
+			data : NewMemStore(),
+			replicas : defaultPastryReplicas,
+			tombstoneGrace : defaultTombstoneGrace,
+		},
+		rtt : make(map[string] time.Duration),
+		dead : make(map[string] time.Time),
+	}
+}
+
+// SetReplicas sets the number of nodes storing each key, at most the node and
+// one half of its leaf set.
+func (this *PastryNode) SetReplicas(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n > pastryLeafHalf + 1 {
+		n = pastryLeafHalf + 1
+	}
+	this.replicas = n
+}
+
+// leaves returns the leaf set. The caller holds the lock.
+func (this *PastryNode) leaves() []string {
+	result := append([]string(nil), this.smaller...)
+	for _, leaf := range this.larger {
+		if !contains(result, leaf) {
+			result = append(result, leaf)
+		}
+	}
+	return result
+}
+
+// known returns every contact of the node. The caller holds the lock.
+func (this *PastryNode) known() []string {
+	result := this.leaves()
+	for _, row := range this.table {
+		for _, entry := range row {
+			if entry != "" && !contains(result, entry) {
+				result = append(result, entry)
+			}
+		}
+	}
+	for _, neighbour := range this.neighbours {
+		if !contains(result, neighbour) {
+			result = append(result, neighbour)
+		}
+	}
+	return result
+}
+
+// setLeaves keeps the closest candidates on either side as the leaf set. The
+// caller holds the lock.
+func (this *PastryNode) setLeaves(candidates []string) {
+	half := func(before func(a, b *big.Int) bool) []string {
+		side := append([]string(nil), candidates...)
+		sort.Slice(side, func(i, j int) bool {
+			return before(hashString(side[i]), hashString(side[j]))
+		})
+		if len(side) > pastryLeafHalf {
+			side = side[: pastryLeafHalf]
+		}
+		return side
+	}
+	this.smaller = half(func(a, b *big.Int) bool {
+		return clockwise(a, this.id).Cmp(clockwise(b, this.id)) < 0
+	})
+	this.larger = half(func(a, b *big.Int) bool {
+		return clockwise(this.id, a).Cmp(clockwise(this.id, b)) < 0
+	})
+}
+
+// covers reports whether id lies within the range of the leaf set, where the
+// node knows the closest node to it. When the two halves meet, the leaf set
+// holds the whole network. The caller holds the lock.
+func (this *PastryNode) covers(id *big.Int) bool {
+	if len(this.smaller) == 0 || len(this.larger) == 0 {
+		return true
+	}
+	for _, leaf := range this.smaller {
+		if contains(this.larger, leaf) {
+			return true
+		}
+	}
+	low := hashString(this.smaller[len(this.smaller) - 1])
+	high := hashString(this.larger[len(this.larger) - 1])
+	return id.Cmp(low) == 0 || between(low, id, high, true)
+}
+
+// replicaSet returns the n nodes of the leaf set closest to id, this node
+// included unless it is leaving.
+func (this *PastryNode) replicaSet(id *big.Int, n int, leaving bool) []string {
+	this.lock.Lock()
+	candidates := this.leaves()
+	this.lock.Unlock()
+	if !leaving {
+		candidates = append(candidates, this.address)
+	}
+	sortByRing(candidates, id)
+	if len(candidates) > n {
+		candidates = candidates[: n]
+	}
+	return candidates
+}
+
+// nextHop returns the node to route id to, or this node if it is the closest
+// one. Within the range of the leaf set, that is the closest leaf. Otherwise it
+// is the routing table entry sharing one more digit with id, or, if the entry
+// is empty, any known node as close to id by prefix and closer numerically.
+func (this *PastryNode) nextHop(id *big.Int) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.covers(id) {
+		candidates := append(this.leaves(), this.address)
+		sortByRing(candidates, id)
+		return candidates[0]
+	}
+	row := sharedPrefix(this.id, id)
+	if row == pastryRows {
+		return this.address
+	}
+	if entry := this.table[row][digit(id, row)] ; entry != "" {
+		return entry
+	}
+	next, limit := this.address, ringDistance(this.id, id)
+	for _, contact := range this.known() {
+		contactID := hashString(contact)
+		if sharedPrefix(contactID, id) >= row && ringDistance(contactID, id).Cmp(limit) < 0 {
+			next, limit = contact, ringDistance(contactID, id)
+		}
+	}
+	return next
+}
+
+// nearer reports whether a is known to be closer than b by round trip. The
+// caller holds the lock.
+func (this *PastryNode) nearer(a, b string) bool {
+	rttA, okA := this.rtt[a]
+	rttB, okB := this.rtt[b]
+	return okA && (!okB || rttA < rttB)
+}
+
+// learn adds a contact heard of from another node to the leaf set and the
+// routing table, where it takes an empty entry or one further away by round
+// trip. Contacts which failed lately are ignored. A new leaf is handed the keys
+// it is now a replica of on the next round.
+func (this *PastryNode) learn(contact string) {
+	if contact == "" || contact == this.address {
+		return
+	}
+	id := hashString(contact)
+	this.lock.Lock()
+	if failed, ok := this.dead[contact] ; ok {
+		if this.clock.Now().Sub(failed) < this.period * time.Duration(pastryForgetRounds) {
+			this.lock.Unlock()
+			return
+		}
+		delete(this.dead, contact)
+	}
+	leaves := this.leaves()
+	isNew := !contains(leaves, contact)
+	if isNew {
+		this.setLeaves(append(leaves, contact))
+	}
+	if isNew && contains(this.leaves(), contact) && !contains(this.arrived, contact) {
+		this.arrived = append(this.arrived, contact)
+	}
+	row := sharedPrefix(this.id, id)
+	if row < pastryRows {
+		col := digit(id, row)
+		if entry := this.table[row][col] ; entry == "" || this.nearer(contact, entry) {
+			this.table[row][col] = contact
+		}
+	}
+	this.lock.Unlock()
+}
+
+// heard learns a contact which was just heard from, even if it failed before.
+func (this *PastryNode) heard(contact string) {
+	this.lock.Lock()
+	delete(this.dead, contact)
+	this.lock.Unlock()
+	this.learn(contact)
+}
+
+// measured records the round trip to a contact, which keeps the neighbourhood
+// set to the closest contacts by round trip.
+func (this *PastryNode) measured(contact string, rtt time.Duration) {
+	if contact == this.address {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if last, ok := this.rtt[contact] ; ok {
+		rtt = (last * 3 + rtt) / 4
+	}
+	this.rtt[contact] = rtt
+	neighbours := this.neighbours
+	if !contains(neighbours, contact) {
+		neighbours = append(neighbours, contact)
+	}
+	sort.Slice(neighbours, func(i, j int) bool {
+		return this.rtt[neighbours[i]] < this.rtt[neighbours[j]]
+	})
+	if len(neighbours) > pastryNeighbours {
+		neighbours = neighbours[: pastryNeighbours]
+	}
+	this.neighbours = neighbours
+}
+
+// drop forgets a contact which failed to answer or left. The leaf set fills up
+// again from the leaf sets of the others.
+func (this *PastryNode) drop(contact string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.smaller = without(this.smaller, contact)
+	this.larger = without(this.larger, contact)
+	for row := range this.table {
+		for col := range this.table[row] {
+			if this.table[row][col] == contact {
+				this.table[row][col] = ""
+			}
+		}
+	}
+	this.neighbours = without(this.neighbours, contact)
+	delete(this.rtt, contact)
+	this.dead[contact] = this.clock.Now()
+}
+
+// call drops the contact if the call cannot reach it. A call which times out
+// leaves it be, as a busy node is slow to answer too; exchange finds the nodes
+// which stay silent.
+func (this *PastryNode) call(ctx context.Context, addr string, method string, args interface{}, reply interface{}) error {
+	if bounded, ok := args.(budgeted) ; ok {
+		args = bounded.withBudget(budgetOf(ctx))
+	}
+	start := this.clock.Now()
+	err := this.transport.Call(ctx, addr, "PastryWrapper." + method, args, reply)
+	if err == nil {
+		this.measured(addr, this.clock.Now().Sub(start))
+	} else if unreachable(ctx, err) {
+		log.Warningf("Node %s drops contact %s: %s.\n", this.address, addr, err)
+		this.drop(addr)
+	}
+	return err
+}
+
+// unreachable reports whether a call failed for want of reaching the node,
+// rather than by an error of the node itself or a timeout.
+func unreachable(ctx context.Context, err error) bool {
+	var serverError rpc.ServerError
+	return ctx.Err() == nil && !errors.As(err, &serverError) && !isTimeout(err)
+}
+
+func (this *PastryNode) readEntry(key string) (StampedEntry, bool) {
+	content, ok := this.data.Get(key)
+	if !ok {
+		return StampedEntry{}, false
+	}
+	return decodeEntry(content), true
+}
+
+// Route forwards the route to the next hop and returns the node closest to the
+// ID. A next hop which cannot be reached is dropped, and the next best one
+// tried.
+func (this *PastryNode) Route(args RouteArgs, root *string) error {
+	ctx, cancel := args.Context()
+	defer cancel()
+	return this.route(ctx, args, root)
+}
+
+func (this *PastryNode) route(ctx context.Context, args RouteArgs, root *string) error {
+	if args.Hops > pastryMaxHops {
+		return fmt.Errorf("%w: %d hops towards %x", NoRouteError, args.Hops, args.ID)
+	}
+	for {
+		next := this.nextHop(args.ID)
+		if next == this.address {
+			*root = this.address
+			return nil
+		}
+		forward := RouteArgs{NewLookupArgs(ctx, args.ID), args.Hops + 1}
+		if err := this.call(ctx, next, "Route", forward, root) ; err == nil || !unreachable(ctx, err) {
+			return err
+		}
+	}
+}
+
+func (this *PastryNode) State(args StateArgs, state *PastryState) error {
+	if args.From != "" {
+		this.heard(args.From)
+	}
+	this.lock.Lock()
+	state.Leaves = this.leaves()
+	for _, row := range this.table {
+		for _, entry := range row {
+			if entry != "" {
+				state.Routes = append(state.Routes, entry)
+			}
+		}
+	}
+	state.Neighbours = append([]string(nil), this.neighbours...)
+	this.lock.Unlock()
+	state.Next = this.nextHop(args.ID)
+	return nil
+}
+
+// Announce learns a node which joined.
+func (this *PastryNode) Announce(addr string, _ *int) error {
+	this.heard(addr)
+	return nil
+}
+
+// Depart drops a node which is leaving.
+func (this *PastryNode) Depart(addr string, _ *int) error {
+	this.drop(addr)
+	return nil
+}
+
+// Store merges the entries, keeping the latest write of each key, and counts
+// the replicas which held a value before. The root of a key, asked to
+// replicate a write, first stamps it later than the entry it holds, so that
+// the writes to a key are ordered by the root whatever the clocks of the
+// writers.
+func (this *PastryNode) Store(args PastryStoreArgs, live *int) error {
+	if args.From != "" {
+		this.heard(args.From)
+	}
+	if args.Replicate {
+		args.Entries = this.stamp(args.Entries)
+	}
+	if err := this.merge(args.Entries, live) ; err != nil {
+		return err
+	}
+	if !args.Replicate {
+		return nil
+	}
+	ctx, cancel := budgetContext(args.Budget)
+	defer cancel()
+	batches := make(map[string] map[string] string)
+	for key, content := range args.Entries {
+		for _, addr := range this.replicaSet(hashString(key), this.replicas, true) {
+			if batches[addr] == nil {
+				batches[addr] = make(map[string] string)
+			}
+			batches[addr][key] = content
+		}
+	}
+	var lock sync.Mutex
+	var calls []func()
+	for addr, entries := range batches {
+		addr, entries := addr, entries
+		calls = append(calls, func() {
+			var held int
+			if err := this.call(ctx, addr, "Store", PastryStoreArgs{From: this.address, Entries: entries}, &held) ; err != nil {
+				log.Errorln("Store: ", err)
+				return
+			}
+			lock.Lock()
+			*live += held
+			lock.Unlock()
+		})
+	}
+	parallel(this.clock, calls)
+	return nil
+}
+
+// stamp returns the entries stamped later than the entries held here.
+func (this *PastryNode) stamp(entries map[string] string) map[string] string {
+	stamped := make(map[string] string, len(entries))
+	now := this.clock.Now()
+	for key, content := range entries {
+		entry := decodeEntry(content)
+		current, _ := this.readEntry(key)
+		entry.At = this.stamps.next(now, current.At)
+		stamped[key] = encodeEntry(entry)
+	}
+	return stamped
+}
+
+func (this *PastryNode) merge(entries map[string] string, live *int) error {
+	merged := make(map[string] string, len(entries))
+	for key, content := range entries {
+		current, ok := this.readEntry(key)
+		if ok && !current.Deleted && live != nil {
+			*live ++
+		}
+		entry := decodeEntry(content)
+		this.stamps.observe(entry.At)
+		if !ok || entry.supersedes(current) {
+			merged[key] = content
+		}
+	}
+	return this.data.PutAll(merged)
+}
+
+// Fetch returns the entry of the key held here. Asked to forward, a node which
+// has none, e.g. because it joined since the write, returns the latest entry
+// held by the rest of the replicas.
+func (this *PastryNode) Fetch(args FetchArgs, reply *FetchReply) error {
+	reply.Entry, reply.Found = this.readEntry(args.Key)
+	if reply.Found || !args.Forward {
+		return nil
+	}
+	ctx, cancel := budgetContext(args.Budget)
+	defer cancel()
+	var lock sync.Mutex
+	var calls []func()
+	for _, addr := range this.replicaSet(hashString(args.Key), this.replicas, true) {
+		addr := addr
+		calls = append(calls, func() {
+			var held FetchReply
+			if err := this.call(ctx, addr, "Fetch", FetchArgs{Key: args.Key}, &held) ; err != nil || !held.Found {
+				return
+			}
+			lock.Lock()
+			if !reply.Found || held.Entry.supersedes(reply.Entry) {
+				*reply = held
+			}
+			lock.Unlock()
+		})
+	}
+	parallel(this.clock, calls)
+	return nil
+}
+
+// onRoot routes to the node closest to the key and calls method on it, once
+// more if that node fails to answer.
+func (this *PastryNode) onRoot(ctx context.Context, key string, method string, args interface{}, reply interface{}) error {
+	var err error
+	for attempt := 0 ; attempt < 2 ; attempt ++ {
+		var root string
+		if err = this.route(ctx, RouteArgs{LookupArgs: NewLookupArgs(ctx, hashString(key))}, &root) ; err != nil {
+			return lookupError(err)
+		}
+		if err = this.call(ctx, root, method, args, reply) ; err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return callError(err)
+}
+
+// write stores the entry on the replicas of the key, and returns how many of
+// them held a value before.
+func (this *PastryNode) write(ctx context.Context, key string, entry StampedEntry) (int, error) {
+	var live int
+	args := PastryStoreArgs{From: this.address, Entries: map[string] string{key: encodeEntry(entry)}, Replicate: true}
+	if err := this.onRoot(ctx, key, "Store", args, &live) ; err != nil {
+		return 0, err
+	}
+	return live, nil
+}
+
+func (this *PastryNode) Put(ctx context.Context, key string, value string) error {
+	_, err := this.write(ctx, key, StampedEntry{Value: value})
+	return err
+}
+
+func (this *PastryNode) Get(ctx context.Context, key string) (string, error) {
+	var reply FetchReply
+	if err := this.onRoot(ctx, key, "Fetch", FetchArgs{Key: key, Forward: true}, &reply) ; err != nil {
+		return "", err
+	}
+	if !reply.Found || reply.Entry.Deleted {
+		return "", NotFoundError
+	}
+	return reply.Entry.Value, nil
+}
+
+// Delete writes a tombstone over the key, which is kept for the grace period so
+// that no replica brings the value back.
+func (this *PastryNode) Delete(ctx context.Context, key string) error {
+	live, err := this.write(ctx, key, StampedEntry{Deleted: true})
+	if err != nil {
+		return err
+	}
+	if live == 0 {
+		return NotFoundError
+	}
+	return nil
+}
+
+// handOver sends the leaves learnt since the last round the keys they are now
+// replicas of, in one pass over the store.
+func (this *PastryNode) handOver() {
+	this.lock.Lock()
+	arrived := this.arrived
+	this.arrived = nil
+	this.lock.Unlock()
+	if len(arrived) == 0 || !this.listening {
+		return
+	}
+	batches := make(map[string] map[string] string)
+	for key, content := range entriesOf(this.data) {
+		replicas := this.replicaSet(hashString(key), this.replicas, false)
+		for _, contact := range arrived {
+			if !contains(replicas, contact) {
+				continue
+			}
+			if batches[contact] == nil {
+				batches[contact] = make(map[string] string)
+			}
+			batches[contact][key] = content
+		}
+	}
+	var calls []func()
+	for contact, entries := range batches {
+		contact, entries := contact, entries
+		calls = append(calls, func() {
+			if err := this.call(context.Background(), contact, "Store", PastryStoreArgs{From: this.address, Entries: entries}, nil) ; err != nil {
+				log.Errorln("handOver: ", err)
+			}
+		})
+	}
+	parallel(this.clock, calls)
+}
+
+// Replicate sends each key to the rest of its replicas, so that a replica which
+// failed is replaced even if it was the closest node. Keys this node is no
+// longer a replica of are dropped once sent, and tombstones past the grace
+// period are dropped instead. A node which is leaving sends every key.
+func (this *PastryNode) Replicate(leaving bool) {
+	cutoff := this.clock.Now().Add(-this.tombstoneGrace).UnixNano()
+	batches := make(map[string] map[string] string)
+	var expired []string
+	moved := make(map[string] []string)
+	for key, content := range entriesOf(this.data) {
+		if entry := decodeEntry(content) ; entry.Deleted && entry.At < cutoff {
+			expired = append(expired, key)
+			continue
+		}
+		replicas := this.replicaSet(hashString(key), this.replicas, leaving)
+		var targets []string
+		switch {
+		case leaving:
+			targets = replicas
+		case !contains(replicas, this.address):
+			targets = replicas
+			moved[key] = replicas
+		default:
+			targets = without(replicas, this.address)
+		}
+		for _, addr := range targets {
+			if batches[addr] == nil {
+				batches[addr] = make(map[string] string)
+			}
+			batches[addr][key] = content
+		}
+	}
+	if err := this.data.DeleteAll(expired) ; err != nil {
+		log.Errorln("Replicate: ", err)
+	}
+	addrs := make([]string, 0, len(batches))
+	for addr := range batches {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var lock sync.Mutex
+	sent := make(map[string] bool)
+	calls := make([]func(), len(addrs))
+	for i, addr := range addrs {
+		addr := addr
+		calls[i] = func() {
+			if err := this.call(context.Background(), addr, "Store", PastryStoreArgs{From: this.address, Entries: batches[addr]}, nil) ; err != nil {
+				log.Errorln("Replicate: ", err)
+				return
+			}
+			lock.Lock()
+			sent[addr] = true
+			lock.Unlock()
+		}
+	}
+	parallel(this.clock, calls)
+	var handed []string
+	for key, replicas := range moved {
+		for _, addr := range replicas {
+			if sent[addr] {
+				handed = append(handed, key)
+				break
+			}
+		}
+	}
+	if err := this.data.DeleteAll(handed) ; err != nil {
+		log.Errorln("Replicate: ", err)
+	}
+	log.Tracef("Node %s replicates to %d nodes and hands %d keys over.\n", this.address, len(addrs), len(handed))
+}
+
+// exchange asks the leaves in turn for their leaf sets, so that the leaf set
+// fills up again after failures. A leaf which does not answer, even by timing
+// out, is dropped.
+func (this *PastryNode) exchange() {
+	this.lock.Lock()
+	leaves := this.leaves()
+	if len(leaves) == 0 {
+		this.lock.Unlock()
+		return
+	}
+	this.turn = (this.turn + 1) % len(leaves)
+	leaf := leaves[this.turn]
+	this.lock.Unlock()
+	var state PastryState
+	if err := this.call(context.Background(), leaf, "State", StateArgs{From: this.address, ID: this.id}, &state) ; err != nil {
+		log.Errorln("exchange: ", err)
+		this.drop(leaf)
+		return
+	}
+	for _, contact := range state.Leaves {
+		this.learn(contact)
+	}
+}
+
+func (this *PastryNode) Maintain() {
+	this.clock.Go(func() {
+		for this.listening {
+			this.clock.Sleep(this.period)
+			if this.listening {
+				this.exchange()
+				this.handOver()
+			}
+		}
+	})
+	this.clock.Go(func() {
+		for this.listening {
+			this.clock.Sleep(this.period * time.Duration(pastryReplicateRounds))
+			if this.listening {
+				this.Replicate(false)
+			}
+		}
+	})
+}
+
+// Join routes towards this node's ID from the node at addr, learning the state
+// of every node on the way: the routing table rows of the first ones and the
+// leaf set of the last one, which is the closest. It then announces itself to
+// every node it learnt, which hand over the keys it is now a replica of on
+// their next round.
+func (this *PastryNode) Join(addr string) error {
+	if !this.transport.Ping(addr) {
+		return NoRouteError
+	}
+	ctx := context.Background()
+	next := addr
+	for hops := 0 ; ; hops ++ {
+		if hops > pastryMaxHops {
+			return NoRouteError
+		}
+		var state PastryState
+		if err := this.call(ctx, next, "State", StateArgs{ID: this.id}, &state) ; err != nil {
+			return err
+		}
+		this.heard(next)
+		for _, contacts := range [][]string{state.Leaves, state.Routes, state.Neighbours} {
+			for _, contact := range contacts {
+				this.learn(contact)
+			}
+		}
+		if state.Next == next || state.Next == this.address {
+			break
+		}
+		next = state.Next
+	}
+	this.announce("Announce")
+	return nil
+}
+
+// announce calls method with the address of this node on every contact.
+func (this *PastryNode) announce(method string) {
+	this.lock.Lock()
+	contacts := this.known()
+	this.lock.Unlock()
+	calls := make([]func(), len(contacts))
+	for i, contact := range contacts {
+		contact := contact
+		calls[i] = func() {
+			if err := this.call(context.Background(), contact, method, this.address, nil) ; err != nil {
+				log.Errorln("announce: ", err)
+			}
+		}
+	}
+	parallel(this.clock, calls)
+}
+
+// Quit sends every key to its replicas, then tells the contacts of the node to
+// drop it.
+func (this *PastryNode) Quit() {
+	this.Replicate(true)
+	this.announce("Depart")
+}
+
+func (this *PastryNode) Clear() {
+	if err := this.data.Clear() ; err != nil {
+		log.Errorln("Clear: ", err)
+	}
+	this.lock.Lock()
+	this.smaller, this.larger, this.neighbours = nil, nil, nil
+	this.table = [pastryRows][pastryCols] string{}
+	this.rtt = make(map[string] time.Duration)
+	this.dead = make(map[string] time.Time)
+	this.arrived = nil
+	this.lock.Unlock()
+}
+
+func (this *PastryNode) Dump() {
+	fmt.Printf("Dumping Pastry node at %s.\n", this.address)
+	this.lock.Lock()
+	fmt.Printf("Leaf set: %v %v\n", this.smaller, this.larger)
+	for i, row := range this.table {
+		for j, entry := range row {
+			if entry != "" {
+				fmt.Printf("Route %d/%x: %s\n", i, j, entry)
+			}
+		}
+	}
+	fmt.Printf("Neighbourhood set: %v\n", this.neighbours)
+	this.lock.Unlock()
+	fmt.Print("Data: {")
+	this.data.Iterate(func(key string, content string) bool {
+		if entry := decodeEntry(content) ; !entry.Deleted {
+			fmt.Printf("{%s: %s}, ", key, entry.Value)
+		}
+		return true
+	})
+	fmt.Printf("}\n")
+}
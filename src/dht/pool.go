@@ -0,0 +1,271 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const defaultPoolConns int = 2
+const defaultPoolStreams int = 32
+const defaultPoolIdle time.Duration = maintainPeriod * 40
+
+// poolMaxFailures is how many calls in a row may time out on a connection
+// before it is taken for hung and dropped.
+const poolMaxFailures int = 3
+
+// ConnPool keeps persistent connections to the peers of an RPCTransport. Calls
+// to a peer share its connections, net/rpc running many of them at once on
+// each. A connection is dropped once it breaks or keeps timing out, and closed
+// once it has been idle for a while.
+type ConnPool struct {
+	MaxConns int          // connections kept per peer
+	MaxStreams int        // calls on a connection before another is opened
+	IdleTimeout time.Duration
+
+	peers map[string] []*pooledConn
+	janitor chan struct{} // closed to stop the janitor, nil if none runs
+	lock sync.Mutex
+}
+
+// pooledConn is a connection of the pool. It takes its place in the pool
+// before it is dialed, so that concurrent calls count it against MaxConns, and
+// ready is closed once client or err is set.
+type pooledConn struct {
+	client *rpc.Client
+	err error
+	ready chan struct{}
+	streams int
+	failures int
+	broken bool
+	lastUsed time.Time
+}
+
+// PeerStats tells how the connections to a peer are doing.
+type PeerStats struct {
+	Conns, Streams int
+	Failures int // calls timed out in a row on the worst connection
+}
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{MaxConns: defaultPoolConns, MaxStreams: defaultPoolStreams, IdleTimeout: defaultPoolIdle}
+}
+
+var defaultPool = NewConnPool()
+
+// Call runs a call on a pooled connection to address, opening one if needed.
+func (this *ConnPool) Call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	if err := ctx.Err() ; err != nil {
+		return err
+	}
+	for trial := 0 ; ; trial ++ {
+		conn, err := this.acquire(address)
+		if err != nil {
+			return err
+		}
+		err = CallFuncContext(ctx, conn.client, method, args, reply)
+		this.release(address, conn, err)
+		// A call on a connection known to be closed was never sent, so that it
+		// is safe to send again on a new one, e.g. once the peer has restarted.
+		if trial > 0 || !errors.Is(err, rpc.ErrShutdown) {
+			return err
+		}
+	}
+}
+
+// acquire returns the least busy healthy connection to address, or a new one
+// if all are busy and there is room for it.
+func (this *ConnPool) acquire(address string) (*pooledConn, error) {
+	if address == "" {
+		return nil, InvalidAddressError
+	}
+	this.lock.Lock()
+	if this.peers == nil {
+		this.peers = make(map[string] []*pooledConn)
+	}
+	if this.janitor == nil && this.IdleTimeout > 0 {
+		this.janitor = make(chan struct{})
+		go this.evictIdle(this.janitor)
+	}
+	var best *pooledConn
+	for _, conn := range this.peers[address] {
+		if !conn.broken && (best == nil || conn.streams < best.streams) {
+			best = conn
+		}
+	}
+	if best != nil && (best.streams < this.MaxStreams || len(this.peers[address]) >= this.MaxConns) {
+		best.streams ++
+		this.lock.Unlock()
+		<- best.ready
+		if best.err != nil {
+			this.lock.Lock()
+			best.streams --
+			this.lock.Unlock()
+			return nil, best.err
+		}
+		return best, nil
+	}
+	conn := &pooledConn{ready: make(chan struct{}), streams: 1}
+	this.peers[address] = append(this.peers[address], conn)
+	this.lock.Unlock()
+
+	client, err := GetClient(address)
+	this.lock.Lock()
+	conn.client, conn.err = client, err
+	if err != nil {
+		conn.streams --
+		this.drop(address, conn)
+	}
+	this.lock.Unlock()
+	close(conn.ready)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// release hands a connection back after a call, and drops it if the call shows
+// that it no longer works.
+func (this *ConnPool) release(address string, conn *pooledConn, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	conn.streams --
+	conn.lastUsed = time.Now()
+	switch {
+	case err == nil:
+		conn.failures = 0
+	case errors.Is(err, TimeOutError):
+		conn.failures ++
+		if conn.failures >= poolMaxFailures {
+			conn.broken = true
+		}
+	case brokenConn(err):
+		conn.broken = true
+	}
+	if conn.broken {
+		this.drop(address, conn)
+	}
+}
+
+// brokenConn tells whether err means that the connection is lost, rather than
+// that the call failed on the remote node.
+func brokenConn(err error) bool {
+	var netError net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netError)
+}
+
+// drop removes conn from the pool, closing it once no call runs on it. The
+// caller must hold the lock.
+func (this *ConnPool) drop(address string, conn *pooledConn) {
+	conns := this.peers[address]
+	for i := range conns {
+		if conns[i] == conn {
+			conns = append(conns[: i], conns[i + 1 :]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(this.peers, address)
+	} else {
+		this.peers[address] = conns
+	}
+	if conn.streams == 0 {
+		if conn.client != nil {
+			conn.client.Close()
+		}
+	} else {
+		conn.broken = true
+	}
+}
+
+// evictIdle closes the connections no call has used for IdleTimeout. It stops
+// once stop is closed, or there is no connection left; acquire starts it again
+// with the next one.
+func (this *ConnPool) evictIdle(stop chan struct{}) {
+	ticker := time.NewTicker(this.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		now := time.Now()
+		this.lock.Lock()
+		for address, conns := range this.peers {
+			for _, conn := range append([]*pooledConn(nil), conns...) {
+				if conn.streams == 0 && now.Sub(conn.lastUsed) > this.IdleTimeout {
+					log.Tracef("Close idle connection to %s.\n", address)
+					this.drop(address, conn)
+				}
+			}
+		}
+		if len(this.peers) == 0 && this.janitor == stop {
+			this.janitor = nil
+			this.lock.Unlock()
+			return
+		}
+		this.lock.Unlock()
+	}
+}
+
+// Forget closes every connection to address, e.g. once the peer is known to
+// have left.
+func (this *ConnPool) Forget(address string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, conn := range append([]*pooledConn(nil), this.peers[address]...) {
+		this.drop(address, conn)
+	}
+}
+
+// Close closes every connection of the pool and stops its janitor. Calls still
+// running keep their connections until they return; the pool can be used again
+// afterwards.
+func (this *ConnPool) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.janitor != nil {
+		close(this.janitor)
+		this.janitor = nil
+	}
+	for address, conns := range this.peers {
+		for _, conn := range append([]*pooledConn(nil), conns...) {
+			this.drop(address, conn)
+		}
+	}
+}
+
+func (this *ConnPool) Stats() map[string] PeerStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	stats := make(map[string] PeerStats, len(this.peers))
+	for address, conns := range this.peers {
+		var peer PeerStats
+		for _, conn := range conns {
+			peer.Conns ++
+			peer.Streams += conn.streams
+			if conn.failures > peer.Failures {
+				peer.Failures = conn.failures
+			}
+		}
+		stats[address] = peer
+	}
+	return stats
+}
+
+// hostService answers the liveness checks of a listener, so that they run on
+// pooled connections instead of dialing.
+type hostService struct{}
+
+const hostServiceName string = "Host"
+
+func (hostService) Ping(_ int, alive *bool) error {
+	*alive = true
+	return nil
+}
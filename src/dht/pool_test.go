@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+type EchoService struct {
+	delay time.Duration
+}
+
+func (this *EchoService) Echo(args string, reply *string) error {
+	time.Sleep(this.delay)
+	*reply = args
+	return nil
+}
+
+// testServer serves an EchoService over TCP and counts the connections it
+// accepts.
+type testServer struct {
+	listener net.Listener
+	accepted int
+	conns []net.Conn
+	lock sync.Mutex
+}
+
+func newTestServer(t *testing.T, address string, delay time.Duration) *testServer {
+	server := rpc.NewServer()
+	if err := server.Register(&EchoService{delay}) ; err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	this := &testServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			this.lock.Lock()
+			this.accepted ++
+			this.conns = append(this.conns, conn)
+			this.lock.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	t.Cleanup(this.Close)
+	return this
+}
+
+func (this *testServer) Accepted() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.accepted
+}
+
+// Close stops the server and breaks the connections it accepted, as a restart
+// of the peer would.
+func (this *testServer) Close() {
+	this.listener.Close()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, conn := range this.conns {
+		conn.Close()
+	}
+	this.conns = nil
+}
+
+func TestConnPoolMaxConns(t *testing.T) {
+	tests := []struct {
+		name string
+		maxConns, maxStreams int
+		calls int
+		want int
+	}{
+		{name : "one stream per connection", maxConns : 2, maxStreams : 1, calls : 8, want : 2},
+		{name : "single connection", maxConns : 1, maxStreams : 1, calls : 8, want : 1},
+		{name : "room for every call", maxConns : 2, maxStreams : 32, calls : 8, want : 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, "127.0.0.1:0", 50 * time.Millisecond)
+			pool := &ConnPool{MaxConns: test.maxConns, MaxStreams: test.maxStreams, IdleTimeout: time.Minute}
+			defer pool.Close()
+			var wg sync.WaitGroup
+			for i := 0 ; i < test.calls ; i ++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var reply string
+					if err := pool.Call(context.Background(), server.listener.Addr().String(), "EchoService.Echo", "hi", &reply) ; err != nil || reply != "hi" {
+						t.Errorf("call got %q, %v", reply, err)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := server.Accepted() ; got != test.want {
+				t.Errorf("%d concurrent calls opened %d connections, want %d", test.calls, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConnPoolRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		restart bool
+		wantErr bool
+	}{
+		{name : "peer restarted", restart : true},
+		{name : "peer gone", restart : false, wantErr : true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, "127.0.0.1:0", 0)
+			address := server.listener.Addr().String()
+			pool := NewConnPool()
+			defer pool.Close()
+			var reply string
+			if err := pool.Call(context.Background(), address, "EchoService.Echo", "first", &reply) ; err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+			if test.restart {
+				newTestServer(t, address, 0)
+			}
+			// Let the client see its connection close, so that the next call
+			// fails to be sent rather than to be answered.
+			time.Sleep(50 * time.Millisecond)
+			err := pool.Call(context.Background(), address, "EchoService.Echo", "second", &reply)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("call after the peer closed: %v", err)
+			}
+			if err == nil && reply != "second" {
+				t.Errorf("call after a restart got %q", reply)
+			}
+		})
+	}
+}
+
+func TestConnPoolJanitor(t *testing.T) {
+	server := newTestServer(t, "127.0.0.1:0", 0)
+	address := server.listener.Addr().String()
+	tests := []struct {
+		name string
+		close bool
+	}{
+		{name : "idle connections evicted"},
+		{name : "pool closed", close : true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := &ConnPool{MaxConns: 1, MaxStreams: 1, IdleTimeout: 20 * time.Millisecond}
+			var reply string
+			if err := pool.Call(context.Background(), address, "EchoService.Echo", "hi", &reply) ; err != nil {
+				t.Fatal(err)
+			}
+			if test.close {
+				pool.Close()
+			} else {
+				time.Sleep(200 * time.Millisecond)
+			}
+			pool.lock.Lock()
+			defer pool.lock.Unlock()
+			if len(pool.peers) != 0 {
+				t.Errorf("%d peers still have connections", len(pool.peers))
+			}
+			if pool.janitor != nil {
+				t.Errorf("janitor still running")
+			}
+		})
+	}
+}
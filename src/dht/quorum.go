@@ -0,0 +1,380 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"sync"
+)
+
+var QuorumError error = errors.New("too few replicas answered")
+
+// Consistency tells how many members of the replica set of a key must answer
+// a request. A positive value asks for that many replicas, capped at the size
+// of the set.
+type Consistency int
+
+const (
+	One Consistency = 1
+	Quorum Consistency = -1
+	All Consistency = -2
+)
+
+const defaultReadConsistency Consistency = One
+const defaultWriteConsistency Consistency = All
+
+// required returns the number of answers needed out of a replica set of n.
+func (this Consistency) required(n int) int {
+	switch {
+	case this == Quorum:
+		return n / 2 + 1
+	case this == All, int(this) > n:
+		return n
+	case int(this) < 1:
+		return 1
+	}
+	return int(this)
+}
+
+func (this Consistency) String() string {
+	switch this {
+	case One:
+		return "ONE"
+	case Quorum:
+		return "QUORUM"
+	case All:
+		return "ALL"
+	}
+	return fmt.Sprintf("%d", int(this))
+}
+
+// GetReplicaSet returns the nodes holding a copy of the keys owned by this
+// node: the node itself first, then the successors keeping its replicas.
+func (this *ChordNode) GetReplicaSet(_ int, set *[]string) error {
+	this.succLock.RLock()
+	targets := this.replicaTargets()
+	this.succLock.RUnlock()
+	*set = []string{this.address}
+	for _, addr := range targets {
+		if addr == "" || addr == this.address {
+			break
+		}
+		duplicate := false
+		for _, member := range *set {
+			if member == addr {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			*set = append(*set, addr)
+		}
+	}
+	return nil
+}
+
+// replicaClient runs requests on the replica sets of keys, for a node of the
+// ring or for a Client outside it. Their versions are issued in the name of
+// actor.
+type replicaClient struct {
+	transport Transport
+	clock Clock
+	actor string
+	lookup func(ctx context.Context, hashValue *big.Int, succaddr *string) error
+}
+
+func (this *ChordNode) replicaClient() *replicaClient {
+	return &replicaClient{transport: this.transport, clock: this.clock, actor: this.address, lookup: this.lookup}
+}
+
+func (this *replicaClient) replicaSet(ctx context.Context, key string) ([]string, error) {
+	var owner string
+	if err := this.lookup(ctx, hashString(key), &owner) ; err != nil {
+		return nil, lookupError(err)
+	}
+	var set []string
+	if err := this.transport.Call(ctx, owner, "RPCWrapper.GetReplicaSet", 0, &set) ; err != nil {
+		return nil, callError(err)
+	}
+	return set, nil
+}
+
+// replicaAck is the answer of a replica to a write: the versions it holds
+// after it, and those it held before.
+type replicaAck struct {
+	versions, previous Siblings
+	err error
+}
+
+// writeReplicas applies write to the replica set and returns once w of them
+// have acknowledged, with the versions they held before. The replicas are
+// tried in order, the owner first, until one issues the version of the write,
+// which write is then given to pass on to the others. Those are all written at
+// once, and the ones yet to answer when w have complete in the background.
+func (this *replicaClient) writeReplicas(ctx context.Context, set []string, w Consistency, write func(ctx context.Context, addr string, primary bool, issued Siblings) replicaAck) (Siblings, error) {
+	required := w.required(len(set))
+	acks := 0
+	var issued, previous Siblings
+	var lastErr error
+	i := 0
+	for ; i < len(set) && issued == nil && ctx.Err() == nil ; i ++ {
+		ack := write(ctx, set[i], i == 0, nil)
+		if ack.err != nil {
+			log.Warningf("Replica %s failed a write: %s.\n", set[i], ack.err)
+			lastErr = ack.err
+			continue
+		}
+		acks ++
+		issued = ack.versions
+		previous = mergeSiblings(previous, ack.previous)
+	}
+	if rest := set[i :] ; issued != nil && len(rest) > 0 {
+		for _, ack := range this.writeRest(ctx, rest, required - acks, issued, write) {
+			if ack.err != nil {
+				lastErr = ack.err
+				continue
+			}
+			acks ++
+			previous = mergeSiblings(previous, ack.previous)
+		}
+	}
+	if acks >= required {
+		return previous, nil
+	}
+	if ctx.Err() != nil {
+		return nil, callError(ctx.Err())
+	}
+	return nil, fmt.Errorf("%w: %d of %d acknowledged: %v", ReplicaWriteError, acks, required, lastErr)
+}
+
+// writeRest passes the issued versions on to the rest of the replica set at
+// once, and returns the answers received by the time needed of them have
+// acknowledged, all have answered, or ctx is done. The writes outlive ctx.
+func (this *replicaClient) writeRest(ctx context.Context, rest []string, needed int, issued Siblings, write func(ctx context.Context, addr string, primary bool, issued Siblings) replicaAck) []replicaAck {
+	results := make(chan replicaAck, len(rest))
+	done := make(chan struct{})
+	var lock sync.Mutex
+	answered, acked, finished := 0, 0, false
+	finish := func() {
+		if !finished {
+			finished = true
+			close(done)
+		}
+	}
+	if needed <= 0 {
+		finish()
+	}
+	for _, addr := range rest {
+		addr := addr
+		this.clock.Go(func() {
+			ack := write(context.Background(), addr, false, issued)
+			if ack.err != nil {
+				log.Warningf("Replica %s failed a write: %s.\n", addr, ack.err)
+			}
+			// Send before counting, so that every answer counted towards
+			// done is there to be received once it is closed.
+			results <- ack
+			lock.Lock()
+			defer lock.Unlock()
+			answered ++
+			if ack.err == nil {
+				acked ++
+			}
+			if acked >= needed || answered == len(rest) {
+				finish()
+			}
+		})
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <- ctx.Done() :
+				lock.Lock()
+				finish()
+				lock.Unlock()
+			case <- done :
+			}
+		}()
+	}
+	this.clock.Wait(done, 0)
+	var acks []replicaAck
+	for {
+		select {
+		case ack := <- results :
+			acks = append(acks, ack)
+		default :
+			return acks
+		}
+	}
+}
+
+// PutOnReplicas writes the pair to the replica set of the key and returns once
+// w replicas hold it. The value supersedes the versions it finds on the first
+// replica to answer a read, and is a sibling of any written since.
+func (this *replicaClient) PutOnReplicas(ctx context.Context, key string, value string, w Consistency) error {
+	log.Tracef("Try to put key %s on chord with consistency %s.\n", key, w)
+	set, err := this.replicaSet(ctx, key)
+	if err != nil {
+		return err
+	}
+	current, err := this.readReplicas(ctx, set, key, One)
+	if err != nil {
+		return err
+	}
+	return this.putVersion(ctx, set, key, value, current.Context(), w)
+}
+
+// PutVersionOnReplicas writes the pair as a successor of the versions merged in
+// seen, e.g. to resolve the siblings returned by GetVersionsOnReplicas. A nil
+// seen is a blind write, which supersedes no version.
+func (this *replicaClient) PutVersionOnReplicas(ctx context.Context, key string, value string, seen VectorClock, w Consistency) error {
+	log.Tracef("Try to put key %s on chord with consistency %s.\n", key, w)
+	set, err := this.replicaSet(ctx, key)
+	if err != nil {
+		return err
+	}
+	return this.putVersion(ctx, set, key, value, seen, w)
+}
+
+// putVersion writes the pair to set. The first replica to accept the write
+// issues its version, which the others then merge.
+func (this *replicaClient) putVersion(ctx context.Context, set []string, key string, value string, seen VectorClock, w Consistency) error {
+	actor := this.actor
+	_, err := this.writeReplicas(ctx, set, w, func(ctx context.Context, addr string, primary bool, issued Siblings) replicaAck {
+		kv := KVPair{Key: key, Value: value, Actor: actor, Context: seen, Versions: issued}
+		method := "RPCWrapper.PutOnBackup"
+		if primary {
+			method = "RPCWrapper.Put"
+		}
+		var versions Siblings
+		if err := this.transport.Call(ctx, addr, method, kv, &versions) ; err != nil {
+			return replicaAck{err: callError(err)}
+		}
+		return replicaAck{versions: versions}
+	})
+	return err
+}
+
+// GetOnReplicas reads the key from r members of its replica set. It returns
+// ConflictError if they hold concurrent versions, see GetVersionsOnReplicas.
+func (this *replicaClient) GetOnReplicas(ctx context.Context, key string, r Consistency) (string, error) {
+	versions, err := this.GetVersionsOnReplicas(ctx, key, r)
+	if err != nil {
+		return "", err
+	}
+	return versions.Value()
+}
+
+// GetVersionsOnReplicas reads the key from r members of its replica set, the
+// owner first, and merges their versions. Tombstones are among them when a
+// delete was concurrent with a write.
+func (this *replicaClient) GetVersionsOnReplicas(ctx context.Context, key string, r Consistency) (Siblings, error) {
+	set, err := this.replicaSet(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := this.readReplicas(ctx, set, key, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(merged.live()) == 0 {
+		return nil, NotFoundError
+	}
+	return merged, nil
+}
+
+// readReplicas merges the versions of the key, tombstones included, held by r
+// members of set, the owner first.
+func (this *replicaClient) readReplicas(ctx context.Context, set []string, key string, r Consistency) (Siblings, error) {
+	required := r.required(len(set))
+	answers := 0
+	var merged Siblings
+	var lastErr error
+	for i, addr := range set {
+		if answers >= required {
+			break
+		}
+		method := "RPCWrapper.GetOnBackup"
+		if i == 0 {
+			method = "RPCWrapper.Get"
+		}
+		var versions Siblings
+		err := callError(this.transport.Call(ctx, addr, method, key, &versions))
+		switch {
+		case err == nil:
+			merged = mergeSiblings(merged, versions)
+			answers ++
+		case errors.Is(err, NotFoundError):
+			answers ++
+		default:
+			lastErr = err
+		}
+	}
+	if answers < required {
+		if ctx.Err() != nil {
+			return nil, callError(ctx.Err())
+		}
+		return nil, fmt.Errorf("%w: %d of %d answered: %v", QuorumError, answers, required, lastErr)
+	}
+	return merged, nil
+}
+
+// DeleteOnReplicas writes a tombstone for the key to its replica set and
+// returns the value it had. A replica that does not hold the key counts as
+// acknowledging. Like a write, the first replica holding the key issues the
+// tombstone, which the others then merge.
+func (this *replicaClient) DeleteOnReplicas(ctx context.Context, key string, w Consistency) (string, error) {
+	log.Tracef("Try to delete key %s on chord with consistency %s.\n", key, w)
+	set, err := this.replicaSet(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	actor := this.actor
+	previous, err := this.writeReplicas(ctx, set, w, func(ctx context.Context, addr string, primary bool, issued Siblings) replicaAck {
+		kv := KVPair{Key: key, Actor: actor, Versions: issued}
+		method := "RPCWrapper.DeleteOnBackup"
+		if primary {
+			method = "RPCWrapper.Delete"
+		}
+		var reply DeleteReply
+		err := callError(this.transport.Call(ctx, addr, method, kv, &reply))
+		if errors.Is(err, NotFoundError) {
+			return replicaAck{}
+		}
+		if err != nil {
+			return replicaAck{err: err}
+		}
+		return replicaAck{versions: reply.Versions, previous: reply.Previous}
+	})
+	if err != nil {
+		return "", err
+	}
+	values := previous.Values()
+	if len(values) == 0 {
+		return "", NotFoundError
+	}
+	return values[0], nil
+}
+
+// The requests of a node of the ring are coordinated by the node itself.
+
+func (this *ChordNode) PutOnReplicas(ctx context.Context, key string, value string, w Consistency) error {
+	return this.replicaClient().PutOnReplicas(ctx, key, value, w)
+}
+
+func (this *ChordNode) PutVersionOnReplicas(ctx context.Context, key string, value string, seen VectorClock, w Consistency) error {
+	return this.replicaClient().PutVersionOnReplicas(ctx, key, value, seen, w)
+}
+
+func (this *ChordNode) GetOnReplicas(ctx context.Context, key string, r Consistency) (string, error) {
+	return this.replicaClient().GetOnReplicas(ctx, key, r)
+}
+
+func (this *ChordNode) GetVersionsOnReplicas(ctx context.Context, key string, r Consistency) (Siblings, error) {
+	return this.replicaClient().GetVersionsOnReplicas(ctx, key, r)
+}
+
+func (this *ChordNode) DeleteOnReplicas(ctx context.Context, key string, w Consistency) (string, error) {
+	return this.replicaClient().DeleteOnReplicas(ctx, key, w)
+}
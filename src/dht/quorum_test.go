@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteReplicas(t *testing.T) {
+	tests := []struct {
+		name string
+		failing map[string] bool
+		slow map[string] bool
+		w Consistency
+		fails bool
+		issuer string
+	}{
+		{name: "all", w: All, issuer: "a"},
+		{name: "owner down", failing: map[string] bool{"a": true}, w: Quorum, issuer: "b"},
+		{name: "too few", failing: map[string] bool{"b": true, "c": true}, w: Quorum, fails: true, issuer: "a"},
+		{name: "one replica slow", slow: map[string] bool{"c": true}, w: Quorum, issuer: "a"},
+	}
+	set := []string{"a", "b", "c"}
+	for _, test := range tests {
+		client := &replicaClient{clock: DefaultClock}
+		release := make(chan struct{})
+		var lock sync.Mutex
+		var wrote []string
+		var issuers []string
+		_, err := client.writeReplicas(context.Background(), set, test.w, func(ctx context.Context, addr string, primary bool, issued Siblings) replicaAck {
+			if test.slow[addr] {
+				<- release
+			}
+			if test.failing[addr] {
+				return replicaAck{err: errors.New("down")}
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			wrote = append(wrote, addr)
+			if issued == nil {
+				issuers = append(issuers, addr)
+				return replicaAck{versions: Siblings{{Value: addr}}}
+			}
+			if issued[0].Value != test.issuer {
+				t.Errorf("%s: %s got versions from %s, want from %s", test.name, addr, issued[0].Value, test.issuer)
+			}
+			return replicaAck{versions: issued}
+		})
+		if (err != nil) != test.fails {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if test.fails && !errors.Is(err, ReplicaWriteError) {
+			t.Errorf("%s: got %v, want ReplicaWriteError", test.name, err)
+		}
+		close(release)
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		if len(issuers) != 1 || issuers[0] != test.issuer {
+			t.Errorf("%s: versions issued by %v, want by %s", test.name, issuers, test.issuer)
+		}
+		if want := len(set) - len(test.failing) ; len(wrote) != want {
+			t.Errorf("%s: %d replicas written, want %d", test.name, len(wrote), want)
+		}
+		lock.Unlock()
+	}
+}
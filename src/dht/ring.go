@@ -0,0 +1,202 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// loopRounds is the number of maintenance periods between two loop repairs,
+// and ringWalkRounds between two walks round the ring.
+const loopRounds int = 4
+const ringWalkRounds int = 32
+
+// maxRingWalk bounds the nodes visited by a walk round the ring.
+const maxRingWalk int = 4096
+
+// RingHealth is what a walk along the successors of a node found. Stabilize
+// only keeps the ring weakly stable: every node is the predecessor of its
+// successor, yet the successors may go round the identifier space more than
+// once, each node's keys being looked up on the wrong loop. The ring is
+// strongly stable when the walk comes back after going round exactly once,
+// with no successor disowning the node before it.
+type RingHealth struct {
+	Nodes int           // nodes visited
+	Wraps int           // times the walk went round the identifier space
+	Inconsistent int    // successors whose predecessor is not the node before
+	Unreachable int     // nodes which did not answer, and were stepped over
+	Complete bool       // the walk came back to its start
+	Repairs int         // successors corrected by loop repair on this node
+	CheckedAt time.Time
+}
+
+func (this RingHealth) Loopy() bool {
+	return this.Wraps > 1
+}
+
+func (this RingHealth) StronglyStable() bool {
+	return this.Complete && this.Wraps == 1 && this.Inconsistent == 0 && this.Unreachable == 0
+}
+
+func (this RingHealth) String() string {
+	state := "strongly stable"
+	switch {
+	case !this.Complete:
+		state = "broken"
+	case this.Loopy():
+		state = "loopy"
+	case !this.StronglyStable():
+		state = "weakly stable"
+	}
+	return fmt.Sprintf("%s: %d nodes, %d wraps, %d inconsistent, %d unreachable, %d repairs", state, this.Nodes, this.Wraps, this.Inconsistent, this.Unreachable, this.Repairs)
+}
+
+// WalkRing follows the successors from this node until it comes back, and
+// tells how the ring looks. It costs two calls per node.
+func (this *ChordNode) WalkRing(ctx context.Context) (RingHealth, error) {
+	health := RingHealth{CheckedAt: this.clock.Now()}
+	visited := make(map[string] bool)
+	prev, cur := "", this.address
+	for health.Nodes < maxRingWalk {
+		if err := ctx.Err() ; err != nil {
+			return health, err
+		}
+		var list [successorLen] string
+		var pred string
+		err := this.transport.Call(ctx, cur, "RPCWrapper.GetSuccessor", 0, &list)
+		if err == nil {
+			err = this.transport.Call(ctx, cur, "RPCWrapper.GetPredecessor", 0, &pred)
+		}
+		var next string
+		if err != nil {
+			if prev == "" {
+				return health, err
+			}
+			// Step over the node, taking the next one from the successor list
+			// of the node before.
+			health.Unreachable ++
+			if next = this.skip(ctx, prev, cur) ; next == "" {
+				return health, err
+			}
+			if wraps(prev, cur) {
+				health.Wraps --
+			}
+			cur = prev
+		} else {
+			visited[cur] = true
+			health.Nodes ++
+			if prev != "" && pred != prev {
+				health.Inconsistent ++
+			}
+			if next = list[0] ; next == "" {
+				return health, InvalidAddressError
+			}
+		}
+		if wraps(cur, next) {
+			health.Wraps ++
+		}
+		if next == this.address {
+			health.Complete = true
+			return health, nil
+		}
+		if visited[next] {
+			// The successors loop without coming back here.
+			return health, nil
+		}
+		prev, cur = cur, next
+	}
+	return health, nil
+}
+
+// wraps tells whether going from a to its successor b crosses zero.
+func wraps(a, b string) bool {
+	return hashString(b).Cmp(hashString(a)) <= 0
+}
+
+// skip returns the node following failed in the successor list of from.
+func (this *ChordNode) skip(ctx context.Context, from, failed string) string {
+	var list [successorLen] string
+	if err := this.transport.Call(ctx, from, "RPCWrapper.GetSuccessor", 0, &list) ; err != nil {
+		return ""
+	}
+	for i := 0 ; i + 1 < successorLen ; i ++ {
+		if list[i] == failed {
+			return list[i + 1]
+		}
+	}
+	return ""
+}
+
+// CheckRing walks the ring and keeps what it found, see RingHealth.
+func (this *ChordNode) CheckRing(ctx context.Context) (RingHealth, error) {
+	health, err := this.WalkRing(ctx)
+	this.healthLock.Lock()
+	health.Repairs = this.health.Repairs
+	this.health = health
+	this.healthLock.Unlock()
+	if err == nil && health.Loopy() {
+		log.Warningf("Node %s finds the ring loopy: %s.\n", this.address, health)
+		this.RepairLoop()
+	}
+	return health, err
+}
+
+// RingHealth returns what the last walk from this node found.
+func (this *ChordNode) RingHealth() RingHealth {
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+	return this.health
+}
+
+// walksRing tells whether this node walks the ring in the background: only the
+// first node past zero does, so that a ring which is not loopy is walked once
+// per round.
+func (this *ChordNode) walksRing() bool {
+	pred := this.firstPredecessor()
+	return pred == "" || hashString(pred).Cmp(hashString(this.address)) >= 0
+}
+
+// RepairLoop has the successor look this node up. On a loopy ring the lookup
+// goes round the other loops and ends at a node between this node and its
+// successor, which becomes the successor instead, merging the loops. It goes
+// by fingers only, as the predecessor lists follow the loops, and the
+// successor would find this node among its own.
+func (this *ChordNode) RepairLoop() {
+	this.succLock.RLock()
+	first := this.successor[0]
+	this.succLock.RUnlock()
+	if first == "" || first == this.address {
+		return
+	}
+	var found string
+	if err := this.transport.Call(context.Background(), first, "RPCWrapper.FindSuccessor", LookupArgs{ID: hashString(this.address), Fingers: true}, &found) ; err != nil {
+		log.Errorln("RepairLoop: ", err)
+		return
+	}
+	if found == "" || found == this.address || !between(hashString(this.address), hashString(found), hashString(first), false) {
+		return
+	}
+	var list [successorLen] string
+	if err := this.transport.Call(context.Background(), found, "RPCWrapper.GetSuccessor", 0, &list) ; err != nil {
+		log.Errorln("RepairLoop: ", err)
+		return
+	}
+	this.succLock.Lock()
+	if this.successor[0] != first {
+		this.succLock.Unlock()
+		return
+	}
+	this.successor[0] = found
+	for i := 1 ; i < successorLen ; i ++ {
+		this.successor[i] = list[i - 1]
+	}
+	this.succLock.Unlock()
+	log.Warningf("Node %s repairs a loop, its successor changing from %s to %s.\n", this.address, first, found)
+	this.healthLock.Lock()
+	this.health.Repairs ++
+	this.healthLock.Unlock()
+	if err := this.transport.Call(context.Background(), found, "RPCWrapper.Notify", this.address, nil) ; err != nil {
+		log.Errorln("RepairLoop: ", err)
+	}
+}
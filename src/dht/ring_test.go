@@ -0,0 +1,178 @@
+package dht
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestWraps(t *testing.T) {
+	nodes := newTestRing(t, NewMemNetwork(), 3)
+	low, high := nodes[0].address, nodes[2].address
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name : "clockwise", a : low, b : high, want : false},
+		{name : "past zero", a : high, b : low, want : true},
+		{name : "own successor", a : low, b : low, want : true},
+	}
+	for _, test := range tests {
+		if got := wraps(test.a, test.b) ; got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// setSuccessors points each node to the one step nodes after it, and the
+// predecessor lists back along the same steps.
+func setSuccessors(nodes []*ChordNode, step int) {
+	n := len(nodes)
+	for i, node := range nodes {
+		for j := 0 ; j < successorLen ; j ++ {
+			node.successor[j] = nodes[(i + (j + 1) * step) % n].address
+			nodes[(i + (j + 1) * step) % n].predecessor[j] = node.address
+		}
+	}
+}
+
+// ghostAfter returns an address nothing is served on, whose ID lies between
+// nodes[i] and the node after it.
+func ghostAfter(nodes []*ChordNode, i int) string {
+	start, end := hashString(nodes[i].address), hashString(nodes[(i + 1) % len(nodes)].address)
+	for port := 1 ; ; port ++ {
+		addr := "127.0.0.1:" + strconv.Itoa(port)
+		if between(start, hashString(addr), end, false) {
+			return addr
+		}
+	}
+}
+
+func TestWalkRing(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		setup func(nodes []*ChordNode)
+		want RingHealth
+		stable bool
+	}{
+		{
+			name : "settled",
+			size : 8,
+			want : RingHealth{Nodes : 8, Wraps : 1, Complete : true},
+			stable : true,
+		},
+		{
+			name : "single node",
+			size : 1,
+			want : RingHealth{Nodes : 1, Wraps : 1, Complete : true},
+			stable : true,
+		},
+		{
+			name : "loopy",
+			size : 8,
+			setup : func(nodes []*ChordNode) {
+				setSuccessors(nodes, 3)
+			},
+			want : RingHealth{Nodes : 8, Wraps : 3, Complete : true},
+		},
+		{
+			// A walk does not see the other ring, see CheckPartition.
+			name : "separate loops",
+			size : 8,
+			setup : func(nodes []*ChordNode) {
+				setSuccessors(nodes, 2)
+			},
+			want : RingHealth{Nodes : 4, Wraps : 1, Complete : true},
+			stable : true,
+		},
+		{
+			name : "stale predecessor",
+			size : 8,
+			setup : func(nodes []*ChordNode) {
+				nodes[5].predecessor[0] = nodes[3].address
+			},
+			want : RingHealth{Nodes : 8, Wraps : 1, Inconsistent : 1, Complete : true},
+		},
+		{
+			name : "failed successor",
+			size : 8,
+			setup : func(nodes []*ChordNode) {
+				list := nodes[2].successor
+				nodes[2].successor = [successorLen] string{ghostAfter(nodes, 2)}
+				copy(nodes[2].successor[1 :], list[:])
+			},
+			want : RingHealth{Nodes : 8, Wraps : 1, Unreachable : 1, Complete : true},
+		},
+		{
+			name : "broken",
+			size : 8,
+			setup : func(nodes []*ChordNode) {
+				nodes[2].successor = [successorLen] string{ghostAfter(nodes, 2)}
+			},
+			want : RingHealth{Nodes : 3, Unreachable : 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := newTestRing(t, NewMemNetwork(), test.size)
+			if test.setup != nil {
+				test.setup(nodes)
+			}
+			health, err := nodes[0].WalkRing(context.Background())
+			if test.want.Complete && err != nil {
+				t.Fatal(err)
+			}
+			health.CheckedAt = test.want.CheckedAt
+			if health != test.want {
+				t.Errorf("got %s, want %s", health, test.want)
+			}
+			if health.StronglyStable() != test.stable {
+				t.Errorf("strongly stable: got %v, want %v", health.StronglyStable(), test.stable)
+			}
+		})
+	}
+}
+
+func TestRepairLoop(t *testing.T) {
+	tests := []struct {
+		name string
+		step int // see setSuccessors
+		repairs bool
+	}{
+		{name : "settled", step : 1, repairs : false},
+		{name : "loopy", step : 3, repairs : true},
+		{name : "loopy the other way", step : 5, repairs : true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := newTestRing(t, NewMemNetwork(), 8)
+			setSuccessors(nodes, test.step)
+			// Each round merges some of the loops, and stabilization then
+			// fixes the successor lists up.
+			for round := 0 ; round < 3 ; round ++ {
+				for _, node := range nodes {
+					node.RepairLoop()
+				}
+				for _, node := range nodes {
+					node.Stabilize()
+				}
+			}
+			health, err := nodes[0].WalkRing(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if health.Wraps != 1 || health.Nodes != len(nodes) {
+				t.Errorf("got %s, want %d nodes wrapping once", health, len(nodes))
+			}
+			repairs := 0
+			for _, node := range nodes {
+				repairs += node.RingHealth().Repairs
+			}
+			if (repairs > 0) != test.repairs {
+				t.Errorf("%d repairs, want any %v", repairs, test.repairs)
+			}
+		})
+	}
+}
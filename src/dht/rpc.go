@@ -1,43 +1,177 @@
 package dht
 
 import (
+	"context"
 	"errors"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 )
 
 var TimeOutError error = errors.New("time out")
 var InvalidAddressError error = errors.New("invalid address")
 
-type Server struct {
+// Transport carries the calls between nodes. A service is served under the name
+// of its type and its methods are called as in net/rpc, e.g.
+// "RPCWrapper.FindSuccessor", with args/reply following the same rules. A call
+// gives up as soon as ctx is done.
+type Transport interface {
+	Serve(address string, service interface{}) (io.Closer, error)
+	Call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error
+	Ping(address string) bool
+}
+
+// RPCTransport is the default transport, using net/rpc over TCP. The virtual
+// nodes of a node share its listener, each serving under a name of its own.
+// Calls go over the connections of Pool, or of a pool shared by the transports
+// which have none.
+type RPCTransport struct {
+	Pool *ConnPool
+
+	hosts map[string] *rpcHost
+	lock sync.Mutex
+}
+
+var DefaultTransport Transport = &RPCTransport{}
+
+// rpcHost is the listener of one address, closed with the last virtual node
+// served on it. net/rpc cannot drop a service, so the others stay registered
+// until then. Closing it closes the connections it accepted as well, which
+// would otherwise keep serving the pools of its peers.
+type rpcHost struct {
+	transport *RPCTransport
+	address string
 	server *rpc.Server
 	listener net.Listener
-	node *RPCWrapper
+	users int
+	conns map[net.Conn] bool
+	connLock sync.Mutex
 }
 
-func NewServer(nd *ChordNode) *Server {
-	return &Server{node : &RPCWrapper{nd}}
+func (this *RPCTransport) Serve(address string, service interface{}) (io.Closer, error) {
+	host, suffix := splitAddress(address)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.hosts == nil {
+		this.hosts = make(map[string] *rpcHost)
+	}
+	shared, ok := this.hosts[host]
+	if !ok {
+		lsn, err := net.Listen("tcp", host)
+		if err != nil {
+			log.Errorln("Listen fail: ", err)
+			return nil, err
+		}
+		shared = &rpcHost{transport : this, address : host, server : rpc.NewServer(), listener : lsn, conns : make(map[net.Conn] bool)}
+		if err := shared.server.RegisterName(hostServiceName, hostService{}) ; err != nil {
+			lsn.Close()
+			return nil, err
+		}
+		go shared.accept()
+		this.hosts[host] = shared
+	}
+	if err := shared.server.RegisterName(serviceName(service) + suffix, service) ; err != nil {
+		log.Errorln("Register fail: ", err)
+		if shared.users == 0 {
+			delete(this.hosts, host)
+			shared.listener.Close()
+		}
+		return nil, err
+	}
+	shared.users ++
+	return shared, nil
 }
 
-func (s *Server) Launch() error {
-	s.server = rpc.NewServer()
-	if err := s.server.Register(s.node) ; err != nil {
-		log.Errorln("Register fail: ", err)
-		return err
+// serviceName is the name net/rpc gives to service.
+func serviceName(service interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(service)).Type().Name()
+}
+
+func (this *rpcHost) accept() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		this.connLock.Lock()
+		this.conns[conn] = true
+		this.connLock.Unlock()
+		go func() {
+			this.server.ServeConn(conn)
+			this.connLock.Lock()
+			delete(this.conns, conn)
+			this.connLock.Unlock()
+		}()
+	}
+}
+
+func (this *rpcHost) Close() error {
+	this.transport.lock.Lock()
+	defer this.transport.lock.Unlock()
+	this.users --
+	if this.users > 0 {
+		return nil
+	}
+	delete(this.transport.hosts, this.address)
+	err := this.listener.Close()
+	this.connLock.Lock()
+	for conn := range this.conns {
+		conn.Close()
 	}
+	this.connLock.Unlock()
+	return err
+}
 
-	lsn, err := net.Listen("tcp", s.node.node.address)
+func (this *RPCTransport) pool() *ConnPool {
+	if this.Pool != nil {
+		return this.Pool
+	}
+	return defaultPool
+}
+
+func (this *RPCTransport) Call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	host, suffix := splitAddress(address)
+	if suffix != "" {
+		method = strings.Replace(method, ".", suffix + ".", 1)
+	}
+	return this.pool().Call(ctx, host, method, args, reply)
+}
+
+// Ping asks a virtual node whether it still serves, since its listener stays
+// open until the first virtual node of the address quits.
+func (this *RPCTransport) Ping(address string) bool {
+	host, suffix := splitAddress(address)
+	if suffix == "" {
+		return checkHost(this.pool(), host)
+	}
+	var alive bool
+	return this.Call(context.Background(), address, "RPCWrapper.Ping", 0, &alive) == nil && alive
+}
+
+type Server struct {
+	transport Transport
+	listener io.Closer
+	node *RPCWrapper
+}
+
+func NewServer(nd *ChordNode, transport Transport) *Server {
+	return &Server{transport : transport, node : &RPCWrapper{nd}}
+}
+
+func (s *Server) Launch() error {
+	lsn, err := s.transport.Serve(s.node.node.address, s.node)
 	if err != nil {
-		log.Errorln("Listen fail: ", err)
 		return err
 	}
 
 	s.listener = lsn
 	s.node.node.Create()
 	s.node.node.listening = true
-	go s.server.Accept(s.listener)
 	return nil
 }
 
@@ -51,14 +185,31 @@ func (s *Server) Shutdown() {
 }
 
 func CallFunc(client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	return CallFuncContext(context.Background(), client, method, args, reply)
+}
+
+// CallFuncContext gives up when ctx is done. A call whose ctx has no deadline
+// times out after 3 maintain periods instead.
+func CallFuncContext(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
 	select {
 	case call := <- client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done :
 		return call.Error
-	case <- time.After(maintainPeriod * 3) :
+	case <- ctx.Done() :
+		return ctx.Err()
+	case <- defaultTimeout(ctx, maintainPeriod * 3) :
 		return TimeOutError
 	}
 }
 
+// defaultTimeout fires after d, unless ctx has a deadline of its own, in which
+// case it never does.
+func defaultTimeout(ctx context.Context, d time.Duration) <-chan time.Time {
+	if _, ok := ctx.Deadline() ; ok {
+		return nil
+	}
+	return time.After(d)
+}
+
 func GetClient(address string) (client *rpc.Client, err error) {
 	if address == "" {
 		return nil, InvalidAddressError
@@ -91,43 +242,29 @@ func GetClient(address string) (client *rpc.Client, err error) {
 }
 
 func CallFuncByAddress(address string, method string, args interface{}, reply interface{}) error {
-	client, err := GetClient(address)
-	if err != nil {
-		return err
-	}
-	return CallFunc(client, method, args, reply)
+	return CallFuncByAddressContext(context.Background(), address, method, args, reply)
+}
+
+func CallFuncByAddressContext(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	return defaultPool.Call(ctx, address, method, args, reply)
 }
 
 func CheckValidRPC(address string) bool {
+	return checkHost(defaultPool, address)
+}
+
+// checkHost asks the listener at address whether it is up, over a pooled
+// connection, with the time two dials would have been given.
+func checkHost(pool *ConnPool, address string) bool {
 	if address == "" {
 		return false
 	}
-	dialError := make(chan error)
-	defer close(dialError)
-	for trial := 0 ; trial < 2 ; trial ++ {
-		go func() {
-			client, err := rpc.Dial("tcp", address)
-			defer func() {
-				if r := recover(); r != nil {
-					log.Errorln("CheckValidRPC: ", r)
-				}
-			}()
-			if client != nil {
-				client.Close()
-			}
-			dialError <- err
-		}()
-		select {
-		case err := <- dialError:
-			if err == nil {
-				return true
-			} else {
-				log.Errorln(err)
-			}
-		case <- time.After(maintainPeriod):
-			log.Errorln(TimeOutError)
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), maintainPeriod * 2)
+	defer cancel()
+	var alive bool
+	if err := pool.Call(ctx, address, hostServiceName + ".Ping", 0, &alive) ; err != nil {
+		log.Warningf("Connection trial to %s fail: %s.\n", address, err)
+		return false
 	}
-	log.Warningf("Connection trial to %s fail.\n", address)
-	return false
-}
\ No newline at end of file
+	return alive
+}
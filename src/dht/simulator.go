@@ -0,0 +1,297 @@
+package dht
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Simulator runs a whole ring on a virtual clock. It is both the Clock and the
+// Transport of its nodes: exactly one simulated goroutine runs at a time, in
+// order of virtual time, and ties and message latencies are drawn from a
+// seeded generator, so that a run is replayed exactly from its seed.
+//
+// Node methods that sleep (Run, Join, Put, Quit, ...) must be called from a
+// simulated goroutine, e.g. inside Simulator.Run.
+//
+// A simulated goroutine must block only through the simulator (Sleep, Wait,
+// Call, Ping). In particular no lock may be held across those: a goroutine
+// waiting for it would keep the others from running, and the one holding it
+// would never be woken. Such a stall panics after StallTimeout of wall time.
+type Simulator struct {
+	MinLatency, MaxLatency time.Duration
+	StallTimeout time.Duration
+
+	seed int64
+	rand *rand.Rand
+	now time.Time
+	seq uint64
+	queue simQueue
+	yield chan struct{}
+	waiters []*simWaiter
+	watchdog *time.Timer
+	services map[string] interface{}
+}
+
+type simEvent struct {
+	at time.Time
+	priority int64
+	seq uint64
+	wake chan struct{}
+	waiter *simWaiter
+	closed bool
+}
+
+// simWaiter is a goroutine in Wait. It is woken by whichever comes first of
+// its timeout and the closing of done, which is checked after every step.
+type simWaiter struct {
+	done <-chan struct{}
+	wake chan struct{}
+	woken, closed bool
+}
+
+type simQueue []*simEvent
+
+func (q simQueue) Len() int {
+	return len(q)
+}
+
+func (q simQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q simQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *simQueue) Push(x interface{}) {
+	*q = append(*q, x.(*simEvent))
+}
+
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old) - 1]
+	*q = old[: len(old) - 1]
+	return ev
+}
+
+func NewSimulator(seed int64) *Simulator {
+	return &Simulator{
+		MinLatency : time.Millisecond,
+		MaxLatency : 10 * time.Millisecond,
+		StallTimeout : 10 * time.Second,
+		seed : seed,
+		rand : rand.New(rand.NewSource(seed)),
+		now : time.Unix(0, 0),
+		yield : make(chan struct{}),
+		services : make(map[string] interface{}),
+	}
+}
+
+func (this *Simulator) Seed() int64 {
+	return this.seed
+}
+
+// Rand is the seeded generator of the simulation. Scenarios should draw their
+// own choices from it so that they are replayed together with the ring.
+func (this *Simulator) Rand() *rand.Rand {
+	return this.rand
+}
+
+// NewNode creates a node whose clock and transport are this simulator.
+func (this *Simulator) NewNode(port int) *DHTNode {
+	node := &DHTNode{}
+	node.SetPortWithTransport(port, this)
+	node.SetClock(this)
+	return node
+}
+
+func (this *Simulator) schedule(d time.Duration) chan struct{} {
+	ev := &simEvent{at: this.now.Add(d), priority: this.rand.Int63(), seq: this.seq, wake: make(chan struct{})}
+	this.seq ++
+	heap.Push(&this.queue, ev)
+	return ev.wake
+}
+
+func (this *Simulator) scheduleWaiter(waiter *simWaiter, d time.Duration, closed bool) {
+	ev := &simEvent{at: this.now.Add(d), priority: this.rand.Int63(), seq: this.seq, wake: waiter.wake, waiter: waiter, closed: closed}
+	this.seq ++
+	heap.Push(&this.queue, ev)
+}
+
+// pollWaiters schedules the waiters whose done channel has been closed.
+func (this *Simulator) pollWaiters() {
+	waiting := this.waiters[: 0]
+	for _, waiter := range this.waiters {
+		if waiter.woken {
+			continue
+		}
+		select {
+		case <- waiter.done :
+			this.scheduleWaiter(waiter, 0, true)
+		default :
+			waiting = append(waiting, waiter)
+		}
+	}
+	for i := len(waiting) ; i < len(this.waiters) ; i ++ {
+		this.waiters[i] = nil
+	}
+	this.waiters = waiting
+}
+
+func (this *Simulator) Now() time.Time {
+	return this.now
+}
+
+func (this *Simulator) Sleep(d time.Duration) {
+	wake := this.schedule(d)
+	this.yield <- struct{}{}
+	<- wake
+}
+
+// Wait only notices done being closed between steps, so done must be closed
+// by a simulated goroutine, or a timeout be given.
+func (this *Simulator) Wait(done <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <- done :
+		return true
+	default :
+	}
+	waiter := &simWaiter{done: done, wake: make(chan struct{})}
+	this.waiters = append(this.waiters, waiter)
+	if timeout > 0 {
+		this.scheduleWaiter(waiter, timeout, false)
+	}
+	this.yield <- struct{}{}
+	<- waiter.wake
+	return waiter.closed
+}
+
+func (this *Simulator) Go(f func()) {
+	wake := this.schedule(0)
+	go func() {
+		<- wake
+		f()
+		this.yield <- struct{}{}
+	}()
+}
+
+func (this *Simulator) step() bool {
+	if len(this.queue) == 0 {
+		return false
+	}
+	ev := heap.Pop(&this.queue).(*simEvent)
+	this.now = ev.at
+	if waiter := ev.waiter ; waiter != nil {
+		if waiter.woken {
+			return true
+		}
+		waiter.woken, waiter.closed = true, ev.closed
+	}
+	close(ev.wake)
+	this.await()
+	this.pollWaiters()
+	return true
+}
+
+// await waits for the running goroutine to yield, and panics if it does not
+// within StallTimeout, as it is then blocked outside the simulator.
+func (this *Simulator) await() {
+	if this.StallTimeout <= 0 {
+		<- this.yield
+		return
+	}
+	if this.watchdog == nil {
+		this.watchdog = time.NewTimer(this.StallTimeout)
+	} else {
+		this.watchdog.Reset(this.StallTimeout)
+	}
+	select {
+	case <- this.yield :
+		this.watchdog.Stop()
+	case <- this.watchdog.C :
+		panic("dht: a simulated goroutine blocked outside the simulator, e.g. on a lock held across a call or sleep")
+	}
+}
+
+// Run starts f as a simulated goroutine and advances the simulation until f
+// returns.
+func (this *Simulator) Run(f func()) {
+	done := false
+	this.Go(func() {
+		f()
+		done = true
+	})
+	for !done && this.step() {
+	}
+}
+
+// RunFor advances the simulation by d of virtual time.
+func (this *Simulator) RunFor(d time.Duration) {
+	deadline := this.now.Add(d)
+	for len(this.queue) > 0 && !this.queue[0].at.After(deadline) {
+		this.step()
+	}
+	this.now = deadline
+}
+
+func (this *Simulator) latency() time.Duration {
+	if this.MaxLatency <= this.MinLatency {
+		return this.MinLatency
+	}
+	return this.MinLatency + time.Duration(this.rand.Int63n(int64(this.MaxLatency - this.MinLatency)))
+}
+
+type simListener struct {
+	simulator *Simulator
+	address string
+}
+
+func (this simListener) Close() error {
+	delete(this.simulator.services, this.address)
+	return nil
+}
+
+func (this *Simulator) Serve(address string, service interface{}) (io.Closer, error) {
+	if _, ok := this.services[address] ; ok {
+		return nil, AddressInUseError
+	}
+	this.services[address] = service
+	return simListener{this, address}, nil
+}
+
+// Call ignores the deadline of ctx, which is on the wall clock, but still
+// honours its cancellation.
+func (this *Simulator) Call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	if address == "" {
+		return InvalidAddressError
+	}
+	if ctx.Done() != nil && ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+	this.Sleep(this.latency())
+	service, ok := this.services[address]
+	if !ok {
+		return UnreachableError
+	}
+	err := dispatchCall(service, method, args, reply)
+	this.Sleep(this.latency())
+	return err
+}
+
+func (this *Simulator) Ping(address string) bool {
+	if address == "" {
+		return false
+	}
+	this.Sleep(this.latency())
+	_, ok := this.services[address]
+	return ok
+}
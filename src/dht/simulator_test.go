@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSimulatorWait(t *testing.T) {
+	tests := []struct {
+		name string
+		close time.Duration
+		timeout time.Duration
+		closed bool
+		elapsed time.Duration
+	}{
+		{"closed first", time.Second, 2 * time.Second, true, time.Second},
+		{"timeout first", 2 * time.Second, time.Second, false, time.Second},
+		{"no timeout", time.Second, 0, true, time.Second},
+	}
+	for _, test := range tests {
+		sim := NewSimulator(1)
+		var closed bool
+		var elapsed time.Duration
+		sim.Run(func() {
+			done := make(chan struct{})
+			start := sim.Now()
+			sim.Go(func() {
+				sim.Sleep(test.close)
+				close(done)
+			})
+			closed = sim.Wait(done, test.timeout)
+			elapsed = sim.Now().Sub(start)
+		})
+		if closed != test.closed || elapsed != test.elapsed {
+			t.Errorf("%s: got closed %v after %v, want %v after %v", test.name, closed, elapsed, test.closed, test.elapsed)
+		}
+	}
+}
+
+func TestSimulatorStall(t *testing.T) {
+	sim := NewSimulator(1)
+	sim.StallTimeout = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	defer func() {
+		if recover() == nil {
+			t.Error("a goroutine blocked outside the simulator did not panic")
+		}
+	}()
+	sim.Run(func() {
+		<- block
+	})
+}
+
+// newSimRing runs n nodes of the simulator and joins them into one ring. It
+// must be called from a simulated goroutine.
+func newSimRing(t *testing.T, sim *Simulator, n int) []*DHTNode {
+	nodes := make([]*DHTNode, n)
+	for i := range nodes {
+		nodes[i] = sim.NewNode(22000 + i)
+		nodes[i].Run()
+		if i > 0 && !nodes[i].Join(nodes[0].node.address) {
+			t.Errorf("node %d failed to join", i)
+		}
+	}
+	return nodes
+}
+
+// churnScenario joins a ring, writes to it, has one node leave and another
+// fail, then reads the keys back. It returns what happened when, and the keys
+// each node ended up with.
+func churnScenario(t *testing.T, seed int64) (trace []string, keys []string) {
+	sim := NewSimulator(seed)
+	sim.Run(func() {
+		nodes := newSimRing(t, sim, 6)
+		for i := 0 ; i < 20 ; i ++ {
+			ok := nodes[i % len(nodes)].Put("key" + strconv.Itoa(i), "value" + strconv.Itoa(i))
+			trace = append(trace, fmt.Sprint(sim.Now(), " put ", i, " ", ok))
+		}
+		nodes[3].Quit()
+		nodes[4].ForceQuit()
+		sim.Sleep(10 * time.Second)
+		for i := 0 ; i < 20 ; i ++ {
+			ok, value := nodes[i % 3].Get("key" + strconv.Itoa(i))
+			if !ok {
+				t.Errorf("seed %d: key%d lost to the churn", seed, i)
+			}
+			trace = append(trace, fmt.Sprint(sim.Now(), " get ", i, " ", ok, " ", value))
+		}
+		for _, node := range nodes {
+			for _, key := range keysOf(entriesOf(node.node.data)) {
+				keys = append(keys, node.node.address + " " + key)
+			}
+		}
+		sort.Strings(keys)
+	})
+	trace = append(trace, fmt.Sprint(sim.Now(), " ", sim.seq, " events"))
+	return trace, keys
+}
+
+func TestSimulatorReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		seed, other int64
+		same bool
+	}{
+		{name : "same seed", seed : 1, other : 1, same : true},
+		{name : "another same seed", seed : 42, other : 42, same : true},
+		{name : "other seed", seed : 1, other : 2, same : false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trace, keys := churnScenario(t, test.seed)
+			otherTrace, otherKeys := churnScenario(t, test.other)
+			if same := reflect.DeepEqual(trace, otherTrace) ; same != test.same {
+				t.Errorf("traces of seeds %d and %d alike: %v, want %v\n%v\n%v", test.seed, test.other, same, test.same, trace, otherTrace)
+			}
+			if test.same && !reflect.DeepEqual(keys, otherKeys) {
+				t.Errorf("seed %d left different keys:\n%v\n%v", test.seed, keys, otherKeys)
+			}
+			if len(keys) == 0 {
+				t.Errorf("seed %d left no keys", test.seed)
+			}
+		})
+	}
+}
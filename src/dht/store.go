@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"math/big"
+	"sync"
+)
+
+// Store keeps the key-value pairs of a node, either its primary data or the
+// replicas it holds for others. Implementations must be safe for concurrent use.
+type Store interface {
+	Get(key string) (string, bool)
+	Put(key string, value string) error
+	Delete(key string) error
+	PutAll(entries map[string] string) error
+	DeleteAll(keys []string) error
+
+	// Range returns the pairs whose key hashes into (start, end].
+	Range(start, end *big.Int) map[string] string
+	// Iterate calls f on every pair until f returns false. f must not modify
+	// the store.
+	Iterate(f func(key string, value string) bool)
+	Len() int
+
+	Clear() error
+	Close() error
+}
+
+// MemStore is a Store kept in memory only.
+type MemStore struct {
+	entries map[string] string
+	lock sync.RWMutex
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{entries : make(map[string] string)}
+}
+
+func (this *MemStore) Get(key string) (string, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	value, ok := this.entries[key]
+	return value, ok
+}
+
+func (this *MemStore) Put(key string, value string) error {
+	this.lock.Lock()
+	this.entries[key] = value
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *MemStore) Delete(key string) error {
+	this.lock.Lock()
+	delete(this.entries, key)
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *MemStore) PutAll(entries map[string] string) error {
+	this.lock.Lock()
+	for key, value := range entries {
+		this.entries[key] = value
+	}
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *MemStore) DeleteAll(keys []string) error {
+	this.lock.Lock()
+	for _, key := range keys {
+		delete(this.entries, key)
+	}
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *MemStore) Range(start, end *big.Int) map[string] string {
+	result := make(map[string] string)
+	this.lock.RLock()
+	for key, value := range this.entries {
+		if between(start, hashString(key), end, true) {
+			result[key] = value
+		}
+	}
+	this.lock.RUnlock()
+	return result
+}
+
+func (this *MemStore) Iterate(f func(key string, value string) bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for key, value := range this.entries {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+func (this *MemStore) Len() int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.entries)
+}
+
+func (this *MemStore) Clear() error {
+	this.lock.Lock()
+	this.entries = make(map[string] string)
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *MemStore) Close() error {
+	return nil
+}
+
+// entriesOf copies the content of a store into a map, e.g. to send it over the
+// transport.
+func entriesOf(store Store) map[string] string {
+	result := make(map[string] string)
+	store.Iterate(func(key string, value string) bool {
+		result[key] = value
+		return true
+	})
+	return result
+}
+
+func keysOf(entries map[string] string) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,40 @@
+package dht
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const defaultTombstoneGrace time.Duration = time.Hour
+
+// expired reports whether the siblings are tombstones only, all written before
+// cutoff.
+func (this Siblings) expired(cutoff int64) bool {
+	for _, sibling := range this {
+		if !sibling.Deleted || sibling.At >= cutoff {
+			return false
+		}
+	}
+	return len(this) > 0
+}
+
+// CollectTombstones drops the keys deleted longer than the grace period ago.
+func (this *ChordNode) CollectTombstones() {
+	cutoff := this.clock.Now().Add(-this.tombstoneGrace).UnixNano()
+	this.dataLock.Lock()
+	defer this.dataLock.Unlock()
+	for _, store := range []Store{this.data, this.backup} {
+		var expired []string
+		store.Iterate(func(key string, content string) bool {
+			if decodeSiblings(content).expired(cutoff) {
+				expired = append(expired, key)
+			}
+			return true
+		})
+		if err := store.DeleteAll(expired) ; err != nil {
+			log.Errorln("CollectTombstones: ", err)
+		} else if len(expired) > 0 {
+			log.Tracef("Node %s collects %d tombstones.\n", this.address, len(expired))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+var ConflictError error = errors.New("concurrent versions")
+
+// VectorClock counts the versions of a key written by each coordinating node.
+type VectorClock map[string] uint64
+
+func (this VectorClock) Copy() VectorClock {
+	clock := make(VectorClock, len(this))
+	for node, count := range this {
+		clock[node] = count
+	}
+	return clock
+}
+
+// Descends reports whether this clock has seen every version other has.
+func (this VectorClock) Descends(other VectorClock) bool {
+	for node, count := range other {
+		if this[node] < count {
+			return false
+		}
+	}
+	return true
+}
+
+func (this VectorClock) Equal(other VectorClock) bool {
+	return this.Descends(other) && other.Descends(this)
+}
+
+// Merge returns the least clock descending from both.
+func (this VectorClock) Merge(other VectorClock) VectorClock {
+	clock := this.Copy()
+	for node, count := range other {
+		if clock[node] < count {
+			clock[node] = count
+		}
+	}
+	return clock
+}
+
+// Dot is the write which issued a version: the Count'th by Actor.
+type Dot struct {
+	Actor string
+	Count uint64
+}
+
+// Sibling is one version of a value. Its Clock holds the versions the write
+// had seen, and its Dot the write itself, so that two writes of one actor on
+// the same context stay siblings. A deleted sibling is a tombstone, which
+// records when the key was deleted.
+//
+// Versions stored before dots were issued have none, and their Clock counts
+// the write itself.
+type Sibling struct {
+	Value string
+	Clock VectorClock
+	Dot Dot
+	Deleted bool `json:",omitempty"`
+	At int64 `json:",omitempty"`
+}
+
+// history merges the clock of the sibling with its dot.
+func (this Sibling) history() VectorClock {
+	if this.Dot.Actor == "" || this.Clock[this.Dot.Actor] >= this.Dot.Count {
+		return this.Clock
+	}
+	return this.Clock.Merge(VectorClock{this.Dot.Actor: this.Dot.Count})
+}
+
+// covers reports whether the sibling supersedes other or is the same version.
+func (this Sibling) covers(other Sibling) bool {
+	if other.Dot.Actor == "" {
+		return this.history().Descends(other.Clock)
+	}
+	return this.Dot == other.Dot || this.Clock[other.Dot.Actor] >= other.Dot.Count
+}
+
+// Siblings are the versions of a key that no other known version supersedes.
+// There is more than one only when writes were concurrent.
+type Siblings []Sibling
+
+// Context merges the clocks of the siblings. Writing with it supersedes all of
+// them, which is how a client resolves a conflict.
+func (this Siblings) Context() VectorClock {
+	clock := make(VectorClock)
+	for _, sibling := range this {
+		clock = clock.Merge(sibling.history())
+	}
+	return clock
+}
+
+func (this Siblings) live() Siblings {
+	var live Siblings
+	for _, sibling := range this {
+		if !sibling.Deleted {
+			live = append(live, sibling)
+		}
+	}
+	return live
+}
+
+// Values returns the distinct values of the siblings which are not tombstones.
+func (this Siblings) Values() []string {
+	var values []string
+	seen := make(map[string] bool)
+	for _, sibling := range this.live() {
+		if !seen[sibling.Value] {
+			seen[sibling.Value] = true
+			values = append(values, sibling.Value)
+		}
+	}
+	return values
+}
+
+// Value returns the value of the key, or ConflictError if the siblings do not
+// agree on it or if a delete was concurrent with a write.
+func (this Siblings) Value() (string, error) {
+	values := this.Values()
+	switch {
+	case len(values) == 0:
+		return "", NotFoundError
+	case len(values) == 1 && len(this.live()) == len(this):
+		return values[0], nil
+	}
+	return "", ConflictError
+}
+
+// mergeSiblings keeps the versions of a and b that the other side does not
+// supersede.
+func mergeSiblings(a, b Siblings) Siblings {
+	var result Siblings
+	for _, candidate := range append(append(Siblings{}, a...), b...) {
+		superseded := false
+		for i, kept := range result {
+			if kept.covers(candidate) {
+				superseded = true
+				break
+			}
+			if candidate.covers(kept) {
+				result[i] = candidate
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			result = append(result, candidate)
+		}
+	}
+	// Replacing a kept version may leave others it supersedes behind.
+	var pruned Siblings
+	for i, sibling := range result {
+		dominated := false
+		for j, other := range result {
+			if i != j && other.covers(sibling) && !sibling.covers(other) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			pruned = append(pruned, sibling)
+		}
+	}
+	sort.SliceStable(pruned, func(i, j int) bool {
+		return pruned[i].Value < pruned[j].Value
+	})
+	return pruned
+}
+
+// issueVersion writes sibling by the actor on top of current, superseding the
+// versions merged in seen. The others stay its siblings, even those the actor
+// issued itself: an empty seen is a blind write, which supersedes nothing, and
+// two writes on the same context are concurrent, so that an update which missed
+// a version shows as a conflict instead of losing it.
+func issueVersion(actor string, current Siblings, sibling Sibling, seen VectorClock) Siblings {
+	count := seen[actor]
+	if held := current.Context()[actor] ; held > count {
+		count = held
+	}
+	sibling.Clock = seen.Copy()
+	sibling.Dot = Dot{Actor: actor, Count: count + 1}
+	return mergeSiblings(current, Siblings{sibling})
+}
+
+// Stores keep the siblings of a key encoded as one string.
+func encodeSiblings(siblings Siblings) string {
+	content, _ := json.Marshal(siblings)
+	return string(content)
+}
+
+// decodeSiblings also accepts a bare value, left by a store written before
+// values were versioned.
+func decodeSiblings(content string) Siblings {
+	var siblings Siblings
+	if json.Unmarshal([]byte(content), &siblings) != nil || len(siblings) == 0 {
+		return Siblings{{Value: content, Clock: VectorClock{}}}
+	}
+	return siblings
+}
@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"reflect"
+	"testing"
+)
+
+func sibling(value string, clock VectorClock) Sibling {
+	return Sibling{Value: value, Clock: clock}
+}
+
+// dotted is the version issued by the count'th write of actor on top of clock.
+func dotted(value string, actor string, count uint64, clock VectorClock) Sibling {
+	return Sibling{Value: value, Clock: clock, Dot: Dot{Actor: actor, Count: count}}
+}
+
+func TestMergeSiblings(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Siblings
+		want Siblings
+	}{
+		{
+			name : "empty",
+			a : nil,
+			b : Siblings{sibling("x", VectorClock{"A": 1})},
+			want : Siblings{sibling("x", VectorClock{"A": 1})},
+		},
+		{
+			name : "descendant wins",
+			a : Siblings{sibling("old", VectorClock{"A": 1})},
+			b : Siblings{sibling("new", VectorClock{"A": 2})},
+			want : Siblings{sibling("new", VectorClock{"A": 2})},
+		},
+		{
+			name : "ancestor loses either way round",
+			a : Siblings{sibling("new", VectorClock{"A": 1, "B": 1})},
+			b : Siblings{sibling("old", VectorClock{"A": 1})},
+			want : Siblings{sibling("new", VectorClock{"A": 1, "B": 1})},
+		},
+		{
+			name : "concurrent versions are kept",
+			a : Siblings{sibling("x", VectorClock{"A": 1})},
+			b : Siblings{sibling("y", VectorClock{"B": 1})},
+			want : Siblings{sibling("x", VectorClock{"A": 1}), sibling("y", VectorClock{"B": 1})},
+		},
+		{
+			name : "equal versions merge",
+			a : Siblings{sibling("x", VectorClock{"A": 1})},
+			b : Siblings{sibling("x", VectorClock{"A": 1})},
+			want : Siblings{sibling("x", VectorClock{"A": 1})},
+		},
+		{
+			name : "resolution supersedes both siblings",
+			a : Siblings{sibling("x", VectorClock{"A": 1}), sibling("y", VectorClock{"B": 1})},
+			b : Siblings{sibling("z", VectorClock{"A": 1, "B": 2})},
+			want : Siblings{sibling("z", VectorClock{"A": 1, "B": 2})},
+		},
+		{
+			name : "tombstone concurrent with a write",
+			a : Siblings{{Deleted: true, Clock: VectorClock{"A": 2}}},
+			b : Siblings{sibling("y", VectorClock{"A": 1, "B": 1})},
+			want : Siblings{{Deleted: true, Clock: VectorClock{"A": 2}}, sibling("y", VectorClock{"A": 1, "B": 1})},
+		},
+		{
+			name : "dotted write supersedes what it saw",
+			a : Siblings{dotted("old", "A", 1, VectorClock{})},
+			b : Siblings{dotted("new", "B", 1, VectorClock{"A": 1})},
+			want : Siblings{dotted("new", "B", 1, VectorClock{"A": 1})},
+		},
+		{
+			name : "same dot merges",
+			a : Siblings{dotted("x", "A", 2, VectorClock{"B": 1})},
+			b : Siblings{dotted("x", "A", 2, VectorClock{"B": 1})},
+			want : Siblings{dotted("x", "A", 2, VectorClock{"B": 1})},
+		},
+		{
+			name : "dots of one actor on the same context",
+			a : Siblings{dotted("x", "A", 2, VectorClock{"A": 1})},
+			b : Siblings{dotted("y", "A", 3, VectorClock{"A": 1})},
+			want : Siblings{dotted("x", "A", 2, VectorClock{"A": 1}), dotted("y", "A", 3, VectorClock{"A": 1})},
+		},
+		{
+			name : "dotted write supersedes an undotted one",
+			a : Siblings{sibling("old", VectorClock{"A": 1})},
+			b : Siblings{dotted("new", "B", 1, VectorClock{"A": 1})},
+			want : Siblings{dotted("new", "B", 1, VectorClock{"A": 1})},
+		},
+	}
+	for _, test := range tests {
+		if got := mergeSiblings(test.a, test.b) ; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIssueVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		actor string
+		current Siblings
+		seen VectorClock
+		want Siblings
+	}{
+		{
+			name : "first write",
+			actor : "A",
+			want : Siblings{dotted("v", "A", 1, VectorClock{})},
+		},
+		{
+			name : "write on top of what was read",
+			actor : "B",
+			current : Siblings{dotted("x", "A", 1, VectorClock{})},
+			seen : VectorClock{"A": 1},
+			want : Siblings{dotted("v", "B", 1, VectorClock{"A": 1})},
+		},
+		{
+			name : "blind write is a sibling",
+			actor : "B",
+			current : Siblings{dotted("x", "A", 1, VectorClock{})},
+			want : Siblings{dotted("v", "B", 1, VectorClock{}), dotted("x", "A", 1, VectorClock{})},
+		},
+		{
+			name : "blind write is a sibling of the actor's own",
+			actor : "A",
+			current : Siblings{dotted("x", "A", 1, VectorClock{})},
+			want : Siblings{dotted("v", "A", 2, VectorClock{}), dotted("x", "A", 1, VectorClock{})},
+		},
+		{
+			name : "two writes of one actor on the same context",
+			actor : "A",
+			current : issueVersion("A", Siblings{dotted("old", "A", 1, VectorClock{})}, Sibling{Value: "x"}, VectorClock{"A": 1}),
+			seen : VectorClock{"A": 1},
+			want : Siblings{dotted("v", "A", 3, VectorClock{"A": 1}), dotted("x", "A", 2, VectorClock{"A": 1})},
+		},
+		{
+			name : "stale context keeps the write missed",
+			actor : "A",
+			current : Siblings{dotted("x", "B", 1, VectorClock{"A": 1})},
+			seen : VectorClock{"A": 1},
+			want : Siblings{dotted("v", "A", 2, VectorClock{"A": 1}), dotted("x", "B", 1, VectorClock{"A": 1})},
+		},
+		{
+			name : "counter moves past the actor's own versions",
+			actor : "A",
+			current : Siblings{dotted("x", "A", 3, VectorClock{}), dotted("y", "B", 1, VectorClock{})},
+			seen : VectorClock{"B": 1},
+			want : Siblings{dotted("v", "A", 4, VectorClock{"B": 1}), dotted("x", "A", 3, VectorClock{})},
+		},
+		{
+			name : "resolving a conflict",
+			actor : "C",
+			current : Siblings{dotted("x", "A", 1, VectorClock{}), dotted("y", "B", 1, VectorClock{})},
+			seen : VectorClock{"A": 1, "B": 1},
+			want : Siblings{dotted("v", "C", 1, VectorClock{"A": 1, "B": 1})},
+		},
+		{
+			name : "undotted versions",
+			actor : "B",
+			current : Siblings{sibling("x", VectorClock{"A": 1})},
+			seen : VectorClock{"A": 1},
+			want : Siblings{dotted("v", "B", 1, VectorClock{"A": 1})},
+		},
+	}
+	for _, test := range tests {
+		got := issueVersion(test.actor, test.current, Sibling{Value: "v"}, test.seen)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -13,26 +13,29 @@ import (
 var (
 	help     bool
 	testName string
+	traceKey string
 )
 
 func init() {
 	flag.BoolVar(&help, "help", false, "help")
-	flag.StringVar(&testName, "test", "", "which test(s) do you want to run: basic/advance/all")
+	flag.StringVar(&testName, "test", "", "which test(s) do you want to run: basic/advance/all, or trace to print the route of a lookup")
+	flag.StringVar(&traceKey, "key", "", "the key whose lookup -test trace prints, a random one if empty")
 
 	flag.Usage = usage
-	//flag.Parse()
 
-	testName = "all"
+	rand.Seed(time.Now().UnixNano())
+}
 
-	if help || (testName != "basic" && testName != "advance" && testName != "all") {
+func main() {
+	flag.Parse()
+	if testName == "" {
+		testName = "all"
+	}
+	if help || (testName != "basic" && testName != "advance" && testName != "all" && testName != "trace") {
 		flag.Usage()
 		os.Exit(0)
 	}
 
-	rand.Seed(time.Now().UnixNano())
-}
-
-func main() {
 	log.SetFormatter(&easy_formatter.Formatter{
 		TimestampFormat: "2006-01-02 15:04:05.000",
 		LogFormat:       "[%lvl%]: %time% - %msg%\n",
@@ -51,6 +54,9 @@ func main() {
 	var QASFailRate float64
 
 	switch testName {
+	case "trace":
+		traceTest(traceKey)
+		return
 	case "all":
 		fallthrough
 	case "basic":
@@ -71,7 +77,7 @@ func main() {
 		if testName == "basic" {
 			break
 		}
-		time.Sleep(afterTestSleepTime)
+		clock.Sleep(afterTestSleepTime)
 		fallthrough
 	case "advance":
 		_, _ = yellow.Println("Advance Test Begins:")
@@ -89,7 +95,7 @@ func main() {
 		} else {
 			_, _ = green.Printf("Force quit test passed with fail rate %.4f\n", forceQuitFailRate)
 		}
-		time.Sleep(afterTestSleepTime)
+		clock.Sleep(afterTestSleepTime)
 		/* ------ Force Quit Test Ends ------ */
 
 		/* ------ Quit & Stabilize Test Begins ------ */
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	traceNodeSize     int = 20
+	traceFromNodeSize int = 3
+)
+
+/* A node which can tell the route of its lookups. */
+type lookupTracer interface {
+	DumpLookup(key string)
+}
+
+/* Build a ring, let it settle, and print the route of a lookup of the key from
+ * a few of its nodes.
+ */
+func traceTest(key string) {
+	if key == "" {
+		key = randString(lengthOfKeyValue)
+	}
+
+	nodes := new([traceNodeSize]dhtNode)
+	nodeAddresses := new([traceNodeSize]string)
+
+	wg = new(sync.WaitGroup)
+	for i := 0; i < traceNodeSize; i++ {
+		nodes[i] = NewNode(firstPort + i)
+		nodeAddresses[i] = portToAddr(localAddress, firstPort+i)
+
+		wg.Add(1)
+		go nodes[i].Run()
+	}
+	clock.Sleep(basicTestAfterRunSleepTime)
+
+	nodes[0].Create()
+	_, _ = cyan.Printf("Start joining %d nodes\n", traceNodeSize)
+	for i := 1; i < traceNodeSize; i++ {
+		if !nodes[i].Join(nodeAddresses[0]) {
+			_, _ = red.Printf("Node %s failed to join.\n", nodeAddresses[i])
+		}
+		clock.Sleep(basicTestJoinQuitSleepTime)
+	}
+	clock.Sleep(basicTestAfterJoinQuitSleepTime)
+
+	for i := 0; i < traceFromNodeSize; i++ {
+		tracer, ok := nodes[i*traceNodeSize/traceFromNodeSize].(lookupTracer)
+		if !ok {
+			_, _ = red.Printf("The %s nodes cannot trace their lookups.\n", protocol)
+			break
+		}
+		tracer.DumpLookup(key)
+	}
+
+	for i := 0; i < traceNodeSize; i++ {
+		nodes[i].Quit()
+	}
+}
@@ -8,10 +8,44 @@ import (
 	"dht"
 )
 
+/* Nodes talk over TCP by default. Set "transport" to dht.NewMemNetwork() to
+ * run the whole ring inside this process without opening any socket.
+ */
+var transport dht.Transport = dht.DefaultTransport
+
+/* Nodes keep time with "clock", and the tests sleep on it as well, so that
+ * they stay in step with the nodes whatever clock is plugged in.
+ */
+var clock dht.Clock = dht.DefaultClock
+
+/* Set "protocol" to "kademlia" or "pastry" to test the Kademlia or Pastry
+ * nodes instead of Chord.
+ */
+var protocol = "chord"
+
+/* Set "lookupMode" to dht.Iterative to have the Chord nodes drive their lookups
+ * themselves instead of handing them from hop to hop.
+ */
+var lookupMode = dht.Recursive
+
 func NewNode(port int) dhtNode {
 	// Todo: create a node and then return it.
+	switch protocol {
+	case "kademlia":
+		node := dht.KademliaDHTNode{}
+		node.SetPortWithTransport(port, transport)
+		node.SetClock(clock)
+		return &node
+	case "pastry":
+		node := dht.PastryDHTNode{}
+		node.SetPortWithTransport(port, transport)
+		node.SetClock(clock)
+		return &node
+	}
 	node := dht.DHTNode{}
-	node.SetPort(port)
+	node.SetPortWithTransport(port, transport)
+	node.SetClock(clock)
+	node.SetLookupMode(lookupMode)
 	return &node
 }
 // Todo: implement a struct which implements the interface "dhtNode".